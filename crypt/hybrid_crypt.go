@@ -0,0 +1,315 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// DataKeySize is the size of the random keys wrapped by hybrid encryption
+	DataKeySize = 32
+	// HybridKeyIDSize is the size of the identifiers of key files
+	HybridKeyIDSize = 16
+	// HybridHeaderSize is the size of the header NewHybridEncrypter writes
+	HybridHeaderSize = 4 + 1 + HybridKeyIDSize
+
+	hybridVersion = 1
+)
+
+var (
+	// ErrNotRSAKey is returned when a key is not a RSA key
+	ErrNotRSAKey = errors.New("key is not a RSA key")
+	// ErrNoRecipient is returned when encrypting for nobody
+	ErrNoRecipient = errors.New("no recipient to encrypt for")
+	// ErrNotRecipient is returned when decrypting with a key that is not one of the recipients
+	ErrNotRecipient = errors.New("key is not a recipient of the message")
+	// hybridMagic starts the files encrypted by NewHybridEncrypter
+	hybridMagic = []byte{'T', 'R', 'I', 'H'}
+	// hybridKeyMagic starts the key files written by NewHybridKey
+	hybridKeyMagic = []byte{'T', 'R', 'I', 'K'}
+)
+
+func (pub *PublicKey) rsaKey() (*rsa.PublicKey, error) {
+	key, err := x509.ParsePKIXPublicKey(pub.AsymPubKey)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, ErrNotRSAKey
+	}
+	return rsaKey, nil
+}
+
+// WrapKey encrypts dataKey so only the PrivateKey of pub can get it back.
+// RSA keys use RSA OAEP with Name as label, X25519 keys see wrapX25519
+func (pub *PublicKey) WrapKey(dataKey []byte) ([]byte, error) {
+	switch pub.keyType() {
+	case KeyTypeRSA:
+		rsaKey, err := pub.rsaKey()
+		if err != nil {
+			return nil, err
+		}
+		return rsa.EncryptOAEP(sha256.New(), rand.Reader, rsaKey, dataKey, pub.Name)
+	case KeyTypeX25519:
+		return pub.wrapX25519(dataKey)
+	default:
+		return nil, ErrUnsupportedKeyType
+	}
+}
+
+// UnwrapKey decrypts a key wrapped by WrapKey of the PublicKey of priv
+func (priv *PrivateKey) UnwrapKey(wrapped []byte) ([]byte, error) {
+	switch priv.PubKey.keyType() {
+	case KeyTypeRSA:
+		rsaKey, err := x509.ParsePKCS1PrivateKey(priv.AsymPrivKey)
+		if err != nil {
+			return nil, err
+		}
+		dataKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, rsaKey, wrapped, priv.PubKey.Name)
+		if err != nil {
+			return nil, ErrCorruptedMessage
+		}
+		return dataKey, nil
+	case KeyTypeX25519:
+		return priv.unwrapX25519(wrapped)
+	default:
+		return nil, ErrUnsupportedKeyType
+	}
+}
+
+// x25519AEAD returns the AEAD wrapping a data key for recipient, keyed with
+// the secret shared between the ephemeral key and recipient
+func x25519AEAD(shared, ephemeral []byte, recipient PublicKey) (cipher.AEAD, error) {
+	salt := append(append([]byte{}, ephemeral...), recipient.AsymPubKey...)
+	info := append([]byte("tri x25519 "), recipient.Name...)
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, info), key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// wrapX25519 wraps dataKey with a key agreed between a new ephemeral key and
+// pub. Format is ephemeral public key / encrypted data key. The AES-GCM key
+// is only used once so the nonce is always zero
+func (pub *PublicKey) wrapX25519(dataKey []byte) ([]byte, error) {
+	if len(pub.AsymPubKey) != x25519KeySize {
+		return nil, ErrUnsupportedKeyType
+	}
+	ephemeralPriv := make([]byte, x25519KeySize)
+	if _, err := io.ReadFull(rand.Reader, ephemeralPriv); err != nil {
+		return nil, err
+	}
+	ephemeral, err := curve25519.X25519(ephemeralPriv, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := curve25519.X25519(ephemeralPriv, pub.AsymPubKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := x25519AEAD(shared, ephemeral, *pub)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(ephemeral, make([]byte, aead.NonceSize()), dataKey, nil), nil
+}
+
+// unwrapX25519 decrypts a key wrapped by wrapX25519
+func (priv *PrivateKey) unwrapX25519(wrapped []byte) ([]byte, error) {
+	if len(wrapped) < x25519KeySize {
+		return nil, ErrCorruptedMessage
+	}
+	ephemeral := wrapped[:x25519KeySize]
+	shared, err := curve25519.X25519(priv.AsymPrivKey, ephemeral)
+	if err != nil {
+		return nil, ErrCorruptedMessage
+	}
+	aead, err := x25519AEAD(shared, ephemeral, priv.PubKey)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := aead.Open(nil, make([]byte, aead.NonceSize()), wrapped[x25519KeySize:], nil)
+	if err != nil {
+		return nil, ErrCorruptedMessage
+	}
+	return dataKey, nil
+}
+
+// wrappedKey is a data key wrapped for the public key with the given fingerprint
+type wrappedKey struct {
+	fingerprint []byte
+	key         []byte
+}
+
+// hybridKey is a data key wrapped for each of its recipients
+type hybridKey struct {
+	recipients []wrappedKey
+}
+
+// marshal returns the key file: magic / version / number of recipients / for
+// each recipient: fingerprint / wrapped key size / wrapped key
+func (h hybridKey) marshal() []byte {
+	buf := bytes.NewBuffer(append([]byte{}, hybridKeyMagic...))
+	buf.WriteByte(hybridVersion)
+	binary.Write(buf, binary.LittleEndian, uint16(len(h.recipients)))
+	for _, r := range h.recipients {
+		buf.Write(r.fingerprint)
+		binary.Write(buf, binary.LittleEndian, uint16(len(r.key)))
+		buf.Write(r.key)
+	}
+	return buf.Bytes()
+}
+
+// parseHybridKey parses the key file written by hybridKey.marshal
+func parseHybridKey(src []byte) (hybridKey, error) {
+	r := bytes.NewReader(src)
+	start := make([]byte, len(hybridKeyMagic)+3)
+	if _, err := io.ReadFull(r, start); err != nil {
+		return hybridKey{}, ErrCorruptedMessage
+	}
+	if !bytes.Equal(start[:len(hybridKeyMagic)], hybridKeyMagic) {
+		return hybridKey{}, ErrCorruptedMessage
+	}
+	if start[len(hybridKeyMagic)] != hybridVersion {
+		return hybridKey{}, ErrUnsupportedStream
+	}
+	h := hybridKey{recipients: make([]wrappedKey, binary.LittleEndian.Uint16(start[len(hybridKeyMagic)+1:]))}
+	for i := range h.recipients {
+		fingerprint := make([]byte, sha256.Size+2)
+		if _, err := io.ReadFull(r, fingerprint); err != nil {
+			return hybridKey{}, ErrCorruptedMessage
+		}
+		key := make([]byte, binary.LittleEndian.Uint16(fingerprint[sha256.Size:]))
+		if _, err := io.ReadFull(r, key); err != nil {
+			return hybridKey{}, ErrCorruptedMessage
+		}
+		h.recipients[i] = wrappedKey{fingerprint: fingerprint[:sha256.Size], key: key}
+	}
+	return h, nil
+}
+
+// dataKey returns the data key unwrapped with priv
+func (h hybridKey) dataKey(priv PrivateKey) ([]byte, error) {
+	fingerprint := priv.PubKey.fingerprint()
+	for _, r := range h.recipients {
+		if bytes.Equal(r.fingerprint, fingerprint) {
+			return priv.UnwrapKey(r.key)
+		}
+	}
+	return nil, ErrNotRecipient
+}
+
+// NewHybridKey returns a new random data key and the key file holding it
+// wrapped for each of the recipients, so only the public keys are needed to
+// encrypt and any of their private keys can decrypt. The key file is kept
+// apart from the files encrypted with the data key (see NewHybridEncrypter),
+// changing the recipients only rewrites it (see RewrapHybridKey)
+func NewHybridKey(recipients []PublicKey) (dataKey, keyFile []byte, err error) {
+	if len(recipients) == 0 {
+		return nil, nil, ErrNoRecipient
+	}
+	dataKey = make([]byte, DataKeySize)
+	if _, err = io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, nil, err
+	}
+	var h hybridKey
+	for _, pub := range recipients {
+		wrapped, err := pub.WrapKey(dataKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		h.recipients = append(h.recipients, wrappedKey{fingerprint: pub.fingerprint(), key: wrapped})
+	}
+	return dataKey, h.marshal(), nil
+}
+
+// UnwrapHybridKey returns the data key of keyFile, written by NewHybridKey,
+// with priv. It returns ErrNotRecipient if priv is not one of its recipients
+func UnwrapHybridKey(priv PrivateKey, keyFile []byte) ([]byte, error) {
+	h, err := parseHybridKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return h.dataKey(priv)
+}
+
+// RewrapHybridKey returns keyFile, written by NewHybridKey, with the data key
+// wrapped for old replaced by one wrapped for newKey. Other recipients are kept
+func RewrapHybridKey(old PrivateKey, newKey PublicKey, keyFile []byte) ([]byte, error) {
+	h, err := parseHybridKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := h.dataKey(old)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := newKey.WrapKey(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	oldFingerprint := old.PubKey.fingerprint()
+	newFingerprint := newKey.fingerprint()
+	rewrapped := hybridKey{recipients: make([]wrappedKey, 0, len(h.recipients))}
+	for _, r := range h.recipients {
+		if bytes.Equal(r.fingerprint, oldFingerprint) || bytes.Equal(r.fingerprint, newFingerprint) {
+			continue
+		}
+		rewrapped.recipients = append(rewrapped.recipients, r)
+	}
+	rewrapped.recipients = append(rewrapped.recipients, wrappedKey{fingerprint: newFingerprint, key: wrapped})
+	return rewrapped.marshal(), nil
+}
+
+// NewHybridEncrypter returns a writer encrypting what is written to it to dst
+// with dataKey, from NewHybridKey, whose key file is identified by keyID.
+// Format is magic / version / key ID / stream (see NewStreamEncrypter), so
+// the header doesn't depend on the recipients. Closing it closes dst
+func NewHybridEncrypter(keyID, dataKey []byte, dst io.WriteCloser) (io.WriteCloser, error) {
+	if len(keyID) != HybridKeyIDSize {
+		return nil, ErrCorruptedMessage
+	}
+	header := append(append(append([]byte{}, hybridMagic...), hybridVersion), keyID...)
+	if _, err := dst.Write(header); err != nil {
+		return nil, err
+	}
+	return NewStreamEncrypter(dataKey, dst)
+}
+
+// NewHybridDecrypter returns a reader decrypting src, encrypted by
+// NewHybridEncrypter, with the data key dataKey returns for its key ID.
+// Closing it closes src
+func NewHybridDecrypter(src io.ReadCloser, dataKey func(keyID []byte) ([]byte, error)) (io.ReadCloser, error) {
+	header := make([]byte, HybridHeaderSize)
+	if _, err := io.ReadFull(src, header); err != nil {
+		return nil, ErrCorruptedMessage
+	}
+	if !bytes.Equal(header[:len(hybridMagic)], hybridMagic) {
+		return nil, ErrCorruptedMessage
+	}
+	if header[len(hybridMagic)] != hybridVersion {
+		return nil, ErrUnsupportedStream
+	}
+	key, err := dataKey(header[len(hybridMagic)+1:])
+	if err != nil {
+		return nil, err
+	}
+	return NewStreamDecrypter(key, src)
+}
@@ -0,0 +1,225 @@
+package crypt
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWrapKey(t *testing.T) {
+	if testing.Short() { // Generation is slow, skip is we want fast
+		t.Skip()
+	}
+	assert := assert.New(t)
+	key, err := GenerateNewKey("testing", 1024) // OAEP needs a bigger key than other tests
+	assert.NoError(err)
+	other, err := GenerateNewKey("testing", 1024)
+	assert.NoError(err)
+
+	dataKey := []byte("0123456789abcdef0123456789abcdef")
+	wrapped, err := key.PubKey.WrapKey(dataKey)
+	assert.NoError(err)
+	assert.Len(wrapped, 1024/8)
+	unwrapped, err := key.UnwrapKey(wrapped)
+	assert.NoError(err)
+	assert.Equal(dataKey, unwrapped)
+
+	_, err = other.UnwrapKey(wrapped)
+	assert.Equal(ErrCorruptedMessage, err)
+	// Name is the label, it has to match
+	renamed := key
+	renamed.PubKey.Name = []byte("renamed")
+	_, err = renamed.UnwrapKey(wrapped)
+	assert.Equal(ErrCorruptedMessage, err)
+}
+
+// hybridEncrypt returns data encrypted by NewHybridEncrypter with the data
+// key of keyFile, unwrapped with priv
+func hybridEncrypt(t *testing.T, priv PrivateKey, keyFile, data []byte) []byte {
+	assert := assert.New(t)
+	dataKey, err := UnwrapHybridKey(priv, keyFile)
+	assert.NoError(err)
+	var out bufferCloser
+	w, err := NewHybridEncrypter(bytes.Repeat([]byte{1}, HybridKeyIDSize), dataKey, &out)
+	assert.NoError(err)
+	_, err = w.Write(data)
+	assert.NoError(err)
+	assert.NoError(w.Close())
+	return out.Bytes()
+}
+
+// hybridDecrypt returns encrypted decrypted with the data key of keyFile,
+// unwrapped with priv
+func hybridDecrypt(priv PrivateKey, keyFile, encrypted []byte) ([]byte, error) {
+	r, err := NewHybridDecrypter(ioutil.NopCloser(bytes.NewReader(encrypted)), func(keyID []byte) ([]byte, error) {
+		if !bytes.Equal(keyID, bytes.Repeat([]byte{1}, HybridKeyIDSize)) {
+			return nil, ErrCorruptedMessage
+		}
+		return UnwrapHybridKey(priv, keyFile)
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func TestHybridEncryptDecrypt(t *testing.T) {
+	if testing.Short() { // Generation is slow, skip is we want fast
+		t.Skip()
+	}
+	assert := assert.New(t)
+	key, err := GenerateNewKey("testing", 1024)
+	assert.NoError(err)
+	other, err := GenerateNewKey("testing", 1024)
+	assert.NoError(err)
+	data := bytes.Repeat([]byte("Hello World! 🍣"), StreamChunkSize/10)
+
+	// Only the public key is needed to encrypt
+	dataKey, keyFile, err := NewHybridKey([]PublicKey{key.PubKey})
+	assert.NoError(err)
+	assert.Len(dataKey, DataKeySize)
+	var out bufferCloser
+	w, err := NewHybridEncrypter(bytes.Repeat([]byte{1}, HybridKeyIDSize), dataKey, &out)
+	assert.NoError(err)
+	_, err = w.Write(data)
+	assert.NoError(err)
+	assert.NoError(w.Close())
+	assert.Equal(HybridHeaderSize+StreamCiphertextSize(int64(len(data))), int64(out.Len()))
+	_, err = NewHybridEncrypter([]byte{1}, dataKey, &bufferCloser{})
+	assert.Equal(ErrCorruptedMessage, err)
+
+	decrypted, err := hybridDecrypt(key, keyFile, out.Bytes())
+	assert.NoError(err)
+	assert.True(bytes.Equal(data, decrypted))
+
+	_, err = hybridDecrypt(other, keyFile, out.Bytes())
+	assert.Equal(ErrNotRecipient, err)
+	_, err = hybridDecrypt(key, keyFile, out.Bytes()[:10])
+	assert.Equal(ErrCorruptedMessage, err)
+	_, err = UnwrapHybridKey(key, keyFile[:10])
+	assert.Equal(ErrCorruptedMessage, err)
+	_, err = UnwrapHybridKey(key, out.Bytes())
+	assert.Equal(ErrCorruptedMessage, err, "a file is not a key file")
+}
+
+func TestHybridMultipleRecipients(t *testing.T) {
+	if testing.Short() { // Generation is slow, skip is we want fast
+		t.Skip()
+	}
+	assert := assert.New(t)
+	keys := make([]PrivateKey, 3)
+	for i := range keys {
+		var err error
+		keys[i], err = GenerateNewKey("testing", 1024)
+		assert.NoError(err)
+	}
+	data := []byte("Hello World! 🍣")
+
+	_, _, err := NewHybridKey(nil)
+	assert.Equal(ErrNoRecipient, err)
+
+	_, keyFile, err := NewHybridKey([]PublicKey{keys[0].PubKey, keys[1].PubKey})
+	assert.NoError(err)
+	encrypted := hybridEncrypt(t, keys[0], keyFile, data)
+
+	// Any recipient can decrypt
+	for _, key := range keys[:2] {
+		decrypted, err := hybridDecrypt(key, keyFile, encrypted)
+		assert.NoError(err)
+		assert.Equal(data, decrypted)
+	}
+	_, err = hybridDecrypt(keys[2], keyFile, encrypted)
+	assert.Equal(ErrNotRecipient, err)
+}
+
+func TestRewrapHybridKey(t *testing.T) {
+	if testing.Short() { // Generation is slow, skip is we want fast
+		t.Skip()
+	}
+	assert := assert.New(t)
+	keys := make([]PrivateKey, 3)
+	for i := range keys {
+		var err error
+		keys[i], err = GenerateNewKey("testing", 1024)
+		assert.NoError(err)
+	}
+	data := []byte("Hello World! 🍣")
+	_, keyFile, err := NewHybridKey([]PublicKey{keys[0].PubKey, keys[1].PubKey})
+	assert.NoError(err)
+	encrypted := hybridEncrypt(t, keys[0], keyFile, data)
+
+	// Replace keys[0] by keys[2], the encrypted files don't change
+	rewrapped, err := RewrapHybridKey(keys[0], keys[2].PubKey, keyFile)
+	assert.NoError(err)
+	assert.Equal(len(keyFile), len(rewrapped))
+	for i, expected := range []error{ErrNotRecipient, nil, nil} {
+		decrypted, err := hybridDecrypt(keys[i], rewrapped, encrypted)
+		assert.Equal(expected, err, "key %d", i)
+		if err == nil {
+			assert.Equal(data, decrypted)
+		}
+	}
+
+	// Only recipients can rewrap
+	_, err = RewrapHybridKey(keys[0], keys[2].PubKey, rewrapped)
+	assert.Equal(ErrNotRecipient, err)
+}
+
+func TestHybridX25519(t *testing.T) {
+	assert := assert.New(t)
+	keys := make([]PrivateKey, 3)
+	for i := range keys {
+		var err error
+		keys[i], err = GenerateX25519Key("testing")
+		assert.NoError(err)
+	}
+	data := []byte("Hello World! 🍣")
+
+	dataKey := []byte("0123456789abcdef0123456789abcdef")
+	wrapped, err := keys[0].PubKey.WrapKey(dataKey)
+	assert.NoError(err)
+	assert.Len(wrapped, x25519KeySize+DataKeySize+16)
+	unwrapped, err := keys[0].UnwrapKey(wrapped)
+	assert.NoError(err)
+	assert.Equal(dataKey, unwrapped)
+	_, err = keys[1].UnwrapKey(wrapped)
+	assert.Equal(ErrCorruptedMessage, err)
+	_, err = keys[0].UnwrapKey(wrapped[:10])
+	assert.Equal(ErrCorruptedMessage, err)
+
+	_, keyFile, err := NewHybridKey([]PublicKey{keys[0].PubKey, keys[1].PubKey})
+	assert.NoError(err)
+	encrypted := hybridEncrypt(t, keys[1], keyFile, data)
+	for i, expected := range []error{nil, nil, ErrNotRecipient} {
+		decrypted, err := hybridDecrypt(keys[i], keyFile, encrypted)
+		assert.Equal(expected, err, "key %d", i)
+		if err == nil {
+			assert.Equal(data, decrypted)
+		}
+	}
+}
+
+func TestHybridMixedKeyTypes(t *testing.T) {
+	if testing.Short() { // Generation is slow, skip is we want fast
+		t.Skip()
+	}
+	assert := assert.New(t)
+	rsaKey, err := GenerateNewKey("testing", 1024)
+	assert.NoError(err)
+	x25519Key, err := GenerateX25519Key("testing")
+	assert.NoError(err)
+	data := []byte("Hello World! 🍣")
+	_, keyFile, err := NewHybridKey([]PublicKey{rsaKey.PubKey})
+	assert.NoError(err)
+	encrypted := hybridEncrypt(t, rsaKey, keyFile, data)
+
+	// Keys can be rotated from one type to the other
+	rewrapped, err := RewrapHybridKey(rsaKey, x25519Key.PubKey, keyFile)
+	assert.NoError(err)
+	decrypted, err := hybridDecrypt(x25519Key, rewrapped, encrypted)
+	assert.NoError(err)
+	assert.Equal(data, decrypted)
+}
@@ -0,0 +1,97 @@
+package crypt
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// KDF identifies a key derivation function, it is stored in encrypted headers
+type KDF uint8
+
+// Supported key derivation functions
+const (
+	KDFPBKDF2SHA256 KDF = 1
+	KDFScrypt       KDF = 2
+)
+
+const (
+	// DefaultSaltSize is the size of the random salt of DefaultKDFParams
+	DefaultSaltSize = 16
+	maxIterations   = 10000000
+	maxScryptN      = 1 << 22
+	maxScryptP      = 16
+	maxScryptMemory = 1 << 30 // 128·N·r·p bytes
+)
+
+var (
+	// DefaultScryptParams are the scrypt cost parameters used by default
+	DefaultScryptParams = ScryptParams{N: 1 << 15, R: 8, P: 1}
+	// ErrUnsupportedKDF is returned when a key derivation function is not one we can handle
+	ErrUnsupportedKDF = errors.New("unsupported key derivation function")
+)
+
+// ScryptParams are the cost parameters of scrypt, see golang.org/x/crypto/scrypt
+type ScryptParams struct {
+	N int `json:"scrypt_n"`
+	R int `json:"scrypt_r"`
+	P int `json:"scrypt_p"`
+}
+
+// valid returns whether the parameters are usable and not too expensive:
+// N, r and p are bounded on their own and so is the memory they need
+func (p ScryptParams) valid() bool {
+	if p.N <= 1 || p.N > maxScryptN || p.N&(p.N-1) != 0 || p.R <= 0 || p.P <= 0 || p.P > maxScryptP {
+		return false
+	}
+	// N and p are bounded so this can only overflow with a huge r
+	if uint64(p.R) > maxScryptMemory {
+		return false
+	}
+	return 128*uint64(p.N)*uint64(p.R)*uint64(p.P) <= maxScryptMemory
+}
+
+// KDFParams describe how a key is derived from a password
+type KDFParams struct {
+	KDF        KDF
+	Salt       []byte
+	Iterations int          // Only used by KDFPBKDF2SHA256
+	Scrypt     ScryptParams // Only used by KDFScrypt
+}
+
+// DefaultKDFParams returns scrypt with DefaultScryptParams and a new random salt
+func DefaultKDFParams() (KDFParams, error) {
+	salt := make([]byte, DefaultSaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return KDFParams{}, err
+	}
+	return KDFParams{
+		KDF:    KDFScrypt,
+		Salt:   salt,
+		Scrypt: DefaultScryptParams,
+	}, nil
+}
+
+// DeriveKey returns a key of size bytes derived from password. It returns
+// ErrCorruptedMessage if the parameters are invalid or too expensive, so
+// they can be checked before trusting a header
+func (p KDFParams) DeriveKey(password []byte, size int) ([]byte, error) {
+	switch p.KDF {
+	case KDFPBKDF2SHA256:
+		if p.Iterations <= 0 || p.Iterations > maxIterations {
+			return nil, ErrCorruptedMessage
+		}
+		return pbkdf2.Key(password, p.Salt, p.Iterations, size, sha256.New), nil
+	case KDFScrypt:
+		if !p.Scrypt.valid() {
+			return nil, ErrCorruptedMessage
+		}
+		return scrypt.Key(password, p.Salt, p.Scrypt.N, p.Scrypt.R, p.Scrypt.P, size)
+	default:
+		return nil, ErrUnsupportedKDF
+	}
+}
@@ -0,0 +1,48 @@
+package crypt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeriveKey(t *testing.T) {
+	assert := assert.New(t)
+	password := []byte("super secret 🍣")
+
+	params, err := DefaultKDFParams()
+	assert.NoError(err)
+	assert.Equal(KDFScrypt, params.KDF)
+	assert.Len(params.Salt, DefaultSaltSize)
+	key, err := params.DeriveKey(password, 32)
+	assert.NoError(err)
+	assert.Len(key, 32)
+	again, err := params.DeriveKey(password, 32)
+	assert.NoError(err)
+	assert.Equal(key, again, "derivation should be deterministic")
+
+	other, err := DefaultKDFParams()
+	assert.NoError(err)
+	otherKey, err := other.DeriveKey(password, 32)
+	assert.NoError(err)
+	assert.NotEqual(key, otherKey, "salt should change the key")
+
+	// Costs are checked
+	for _, p := range []KDFParams{
+		KDFParams{KDF: KDFPBKDF2SHA256, Iterations: 0},
+		KDFParams{KDF: KDFPBKDF2SHA256, Iterations: maxIterations + 1},
+		KDFParams{KDF: KDFScrypt, Scrypt: ScryptParams{N: 3, R: 8, P: 1}},
+		KDFParams{KDF: KDFScrypt, Scrypt: ScryptParams{N: maxScryptN * 2, R: 8, P: 1}},
+		KDFParams{KDF: KDFScrypt, Scrypt: ScryptParams{N: maxScryptN, R: 1 << 20, P: 1}},
+		KDFParams{KDF: KDFScrypt, Scrypt: ScryptParams{N: maxScryptN, R: 8, P: 1}},
+		KDFParams{KDF: KDFScrypt, Scrypt: ScryptParams{N: 1 << 10, R: 1 << 30, P: maxScryptP}},
+		KDFParams{KDF: KDFScrypt, Scrypt: ScryptParams{N: 1 << 10, R: 1, P: maxScryptP + 1}},
+		KDFParams{KDF: KDFScrypt, Scrypt: ScryptParams{N: 1 << 10, R: 8, P: 0}},
+	} {
+		_, err = p.DeriveKey(password, 32)
+		assert.Equal(ErrCorruptedMessage, err, "%+v", p)
+	}
+	assert.True(ScryptParams{N: 1 << 20, R: 8, P: 1}.valid(), "1 GiB should be allowed")
+	_, err = KDFParams{KDF: 42}.DeriveKey(password, 32)
+	assert.Equal(ErrUnsupportedKDF, err)
+}
@@ -5,45 +5,79 @@ import (
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"strconv"
 
-	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/curve25519"
 )
 
 const (
 	// DefaultBitsSize is the default bits size of the key
 	DefaultBitsSize = 8192
 	// KeyVersion is the versioning of the Marshaling/Unmarshaling of the key
-	KeyVersion = 1
+	KeyVersion = 2
+
+	// KeyTypeRSA is a RSA key, data keys are wrapped with RSA OAEP.
+	// Keys without a type are RSA keys
+	KeyTypeRSA KeyType = "rsa"
+	// KeyTypeX25519 is a Curve25519 key, data keys are wrapped with a key
+	// agreed with X25519 with an ephemeral key
+	KeyTypeX25519 KeyType = "x25519"
+
+	// x25519KeySize is the size of both the X25519 private and public keys
+	x25519KeySize = 32
 )
 
 var (
 	// ErrUnsuportedVersion is returned when there is a key version we can't handle
 	ErrUnsuportedVersion = errors.New("unsupported version")
+	// ErrUnsupportedKeyType is returned when there is a key type we can't handle
+	ErrUnsupportedKeyType = errors.New("unsupported key type")
 )
 
+// KeyType is the kind of asymmetric key of a PublicKey
+type KeyType string
+
 // PublicKey defines a tri PublicKey. name is an identifier of the key which can
 // be arbitrary, it is used as a label to the RSA OAEP encryption
 // (so when decrypting you now it was encrypted with the same key); it is optional
-// asyncPubKey is a RSA public key
+// asyncPubKey is a RSA public key (PKIX) or a X25519 public key, depending on Type
 type PublicKey struct {
 	AsymPubKey []byte
 	KeyLength  int
 	Name       []byte
+	Type       KeyType
 }
 
 // PrivateKey is the private counter-part to PublicKey. It is a RSA private key
+// (PKCS1) or a X25519 private key
 type PrivateKey struct {
 	AsymPrivKey []byte
 	PubKey      PublicKey
 }
 
-// GetWeakKey returns the "weak" (tri-terminology) symetric key used to encode/decode
-func (pub *PublicKey) GetWeakKey() []byte {
-	return pbkdf2.Key(pub.AsymPubKey, pub.Name, 3, pub.KeyLength, sha256.New)
+// keyType returns the type of the key, RSA if it is not set
+func (pub *PublicKey) keyType() KeyType {
+	if pub.Type == "" {
+		return KeyTypeRSA
+	}
+	return pub.Type
+}
+
+// Fingerprint returns a short identifier of the public key: the hex encoded
+// SHA256 of AsymPubKey, so of the PKIX encoding of a RSA key or of the 32
+// bytes of a X25519 key
+func (pub *PublicKey) Fingerprint() string {
+	return hex.EncodeToString(pub.fingerprint())
+}
+
+func (pub *PublicKey) fingerprint() []byte {
+	sum := sha256.Sum256(pub.AsymPubKey)
+	return sum[:]
 }
 
 type jsonPublicKey struct {
@@ -53,6 +87,7 @@ type jsonPublicKey struct {
 	AsymPubKey       []byte `json:"pub_key"`
 	EncryptedVersion []byte `json:"encrypted_version"`
 	Name             []byte `json:"name"`
+	KeyType          []byte `json:"key_type,omitempty"` // Since version 2
 }
 
 // Marshal returns a bytes blob representing a public key
@@ -69,12 +104,17 @@ func (pub *PublicKey) Marshal(key string) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	keyType, err := SymetricEncrypt([]byte(key), nil, []byte(pub.keyType()))
+	if err != nil {
+		return nil, err
+	}
 	j := jsonPublicKey{
 		KeyLength:        pub.KeyLength,
 		Version:          KeyVersion,
 		AsymPubKey:       asymK,
 		EncryptedVersion: encryptedVersion,
 		Name:             name,
+		KeyType:          keyType,
 	}
 	return json.Marshal(j)
 }
@@ -88,7 +128,7 @@ func ParsePublicKey(key string, src []byte) (PublicKey, error) {
 	}
 
 	// Check that the message is authentic first
-	if j.Version != 1 {
+	if j.Version != 1 && j.Version != KeyVersion {
 		return PublicKey{}, ErrUnsuportedVersion
 	}
 	decryptedVersion, err := SymetricDecrypt([]byte(key), nil, j.EncryptedVersion)
@@ -111,14 +151,23 @@ func ParsePublicKey(key string, src []byte) (PublicKey, error) {
 	if err != nil {
 		return PublicKey{}, err
 	}
+	keyType := KeyTypeRSA // Version 1 only has RSA keys
+	if j.Version >= 2 {
+		decryptedType, err := SymetricDecrypt([]byte(key), nil, j.KeyType)
+		if err != nil {
+			return PublicKey{}, err
+		}
+		keyType = KeyType(decryptedType)
+	}
 	return PublicKey{
 		AsymPubKey: pubKey,
 		KeyLength:  j.KeyLength,
 		Name:       name,
+		Type:       keyType,
 	}, nil
 }
 
-// GenerateNewKey generates a new set of PrivateKey and PublicKey
+// GenerateNewKey generates a new set of RSA PrivateKey and PublicKey
 // name is an identifier of the key which can
 // be arbitrary, it is used as a label to the RSA OAEP encryption
 // (so when decrypting you now it was encrypted with the same key); it is optional
@@ -137,6 +186,7 @@ func GenerateNewKey(name string, bits int) (PrivateKey, error) {
 		AsymPubKey: pubBytes,
 		KeyLength:  bits,
 		Name:       []byte(name),
+		Type:       KeyTypeRSA,
 	}
 	privKey := PrivateKey{
 		AsymPrivKey: privBytes,
@@ -144,3 +194,38 @@ func GenerateNewKey(name string, bits int) (PrivateKey, error) {
 	}
 	return privKey, nil
 }
+
+// GenerateX25519Key generates a new set of X25519 PrivateKey and PublicKey.
+// It is much faster than GenerateNewKey and the keys are much smaller
+func GenerateX25519Key(name string) (PrivateKey, error) {
+	priv := make([]byte, x25519KeySize)
+	if _, err := io.ReadFull(rand.Reader, priv); err != nil {
+		return PrivateKey{}, err
+	}
+	pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		return PrivateKey{}, err
+	}
+	return PrivateKey{
+		AsymPrivKey: priv,
+		PubKey: PublicKey{
+			AsymPubKey: pub,
+			KeyLength:  x25519KeySize * 8,
+			Name:       []byte(name),
+			Type:       KeyTypeX25519,
+		},
+	}, nil
+}
+
+// GenerateKey generates a new set of PrivateKey and PublicKey of the given
+// type, bits is only used for RSA keys
+func GenerateKey(keyType KeyType, name string, bits int) (PrivateKey, error) {
+	switch keyType {
+	case KeyTypeRSA:
+		return GenerateNewKey(name, bits)
+	case KeyTypeX25519:
+		return GenerateX25519Key(name)
+	default:
+		return PrivateKey{}, ErrUnsupportedKeyType
+	}
+}
@@ -1,6 +1,7 @@
 package crypt
 
 import (
+	"encoding/json"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -21,20 +22,6 @@ func TestGenerationKey(t *testing.T) {
 	assert.Equal(testName, string(key.PubKey.Name))
 }
 
-func TestGenerationWeakKey(t *testing.T) {
-	if testing.Short() { // Generation is slow, skip is we want fast
-		t.Skip()
-	}
-	assert := assert.New(t)
-	keyLength := 256 // Use a smaller key for tests
-	testName := "testing"
-	key, err := GenerateNewKey(testName, keyLength)
-	assert.NoError(err)
-	weak := key.PubKey.GetWeakKey()
-	assert.Equal(keyLength, len(weak))
-	assert.Equal(key.PubKey.GetWeakKey(), weak) // Regeneration is consistent
-}
-
 func TestPublicMarshaling(t *testing.T) {
 	if testing.Short() { // Generation is slow, skip is we want fast
 		t.Skip()
@@ -55,3 +42,61 @@ func TestPublicMarshaling(t *testing.T) {
 	assert.Equal(public.KeyLength, unmarshalled.KeyLength)
 	assert.Equal(public.Name, unmarshalled.Name)
 }
+
+func TestGenerationX25519Key(t *testing.T) {
+	assert := assert.New(t)
+	key, err := GenerateKey(KeyTypeX25519, "testing", 0)
+	assert.NoError(err)
+	assert.Len(key.AsymPrivKey, 32)
+	assert.Len(key.PubKey.AsymPubKey, 32)
+	assert.Equal(KeyTypeX25519, key.PubKey.Type)
+	assert.Equal("testing", string(key.PubKey.Name))
+	other, err := GenerateX25519Key("testing")
+	assert.NoError(err)
+	assert.NotEqual(key.PubKey.Fingerprint(), other.PubKey.Fingerprint())
+
+	_, err = GenerateKey("dsa", "testing", 0)
+	assert.Equal(ErrUnsupportedKeyType, err)
+}
+
+func TestX25519Marshaling(t *testing.T) {
+	assert := assert.New(t)
+	password := "super secret"
+	key, err := GenerateX25519Key("testing")
+	assert.NoError(err)
+
+	marshalled, err := key.PubKey.Marshal(password)
+	assert.NoError(err)
+	public, err := ParsePublicKey(password, marshalled)
+	assert.NoError(err)
+	assert.Equal(key.PubKey, public)
+
+	marshalled, err = key.Marshal(password)
+	assert.NoError(err)
+	private, err := ParsePrivateKey(password, marshalled)
+	assert.NoError(err)
+	assert.Equal(key, private)
+}
+
+func TestParsePublicKeyVersion1(t *testing.T) {
+	assert := assert.New(t)
+	password := "super secret"
+	encrypt := func(plain string) []byte {
+		encrypted, err := SymetricEncrypt([]byte(password), nil, []byte(plain))
+		assert.NoError(err)
+		return encrypted
+	}
+	// Version 1 has no key type, all keys are RSA keys
+	marshalled, err := json.Marshal(jsonPublicKey{
+		KeyLength:        256,
+		Version:          1,
+		AsymPubKey:       encrypt("public key"),
+		EncryptedVersion: encrypt("1"),
+		Name:             encrypt("testing"),
+	})
+	assert.NoError(err)
+	public, err := ParsePublicKey(password, marshalled)
+	assert.NoError(err)
+	assert.Equal(KeyTypeRSA, public.Type)
+	assert.Equal("public key", string(public.AsymPubKey))
+}
@@ -0,0 +1,108 @@
+package crypt
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// MasterKeySize is the size of the keys derived from a passphrase
+	MasterKeySize = 32
+	// MasterKeyVersion is the versioning of the master key header
+	MasterKeyVersion = 1
+)
+
+// jsonMasterKeyHeader is stored in clear, Check authenticates the rest
+type jsonMasterKeyHeader struct {
+	Version int    `json:"version"`
+	KDF     string `json:"kdf"`
+	Salt    []byte `json:"salt"`
+	ScryptParams
+	Check []byte `json:"check,omitempty"`
+}
+
+// check returns the MAC, with a key derived from key, of the header
+// without its check
+func (h jsonMasterKeyHeader) check(key []byte) ([]byte, error) {
+	checkKey := make([]byte, 32)
+	_, err := io.ReadFull(hkdf.New(sha256.New, key, nil, []byte("tri master key check")), checkKey)
+	if err != nil {
+		return nil, err
+	}
+	h.Check = nil
+	data, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, checkKey)
+	mac.Write(data)
+	return mac.Sum(nil), nil
+}
+
+// derive returns the master key derived from passphrase as described by h
+func (h jsonMasterKeyHeader) derive(passphrase []byte) ([]byte, error) {
+	if h.KDF != privateKeyKDF {
+		return nil, ErrUnsupportedKDF
+	}
+	if len(h.Salt) == 0 {
+		return nil, ErrCorruptedMessage
+	}
+	params := KDFParams{KDF: KDFScrypt, Salt: h.Salt, Scrypt: h.ScryptParams}
+	return params.DeriveKey(passphrase, MasterKeySize)
+}
+
+// NewMasterKey returns a new master key derived from passphrase with scrypt
+// and a random salt, and the header needed to derive it again (see
+// ParseMasterKey). The header doesn't need to be kept secret
+func NewMasterKey(passphrase []byte) (key, header []byte, err error) {
+	h := jsonMasterKeyHeader{
+		Version:      MasterKeyVersion,
+		KDF:          privateKeyKDF,
+		Salt:         make([]byte, DefaultSaltSize),
+		ScryptParams: DefaultScryptParams,
+	}
+	if _, err = io.ReadFull(rand.Reader, h.Salt); err != nil {
+		return nil, nil, err
+	}
+	if key, err = h.derive(passphrase); err != nil {
+		return nil, nil, err
+	}
+	if h.Check, err = h.check(key); err != nil {
+		return nil, nil, err
+	}
+	header, err = json.Marshal(h)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, header, nil
+}
+
+// ParseMasterKey returns the master key derived from passphrase as described
+// by header, written by NewMasterKey. It returns ErrCorruptedMessage if the
+// passphrase is wrong or the header was tampered with
+func ParseMasterKey(passphrase, header []byte) ([]byte, error) {
+	var h jsonMasterKeyHeader
+	if err := json.Unmarshal(header, &h); err != nil {
+		return nil, err
+	}
+	if h.Version != MasterKeyVersion {
+		return nil, ErrUnsuportedVersion
+	}
+	key, err := h.derive(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	check, err := h.check(key)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(check, h.Check) {
+		return nil, ErrCorruptedMessage
+	}
+	return key, nil
+}
@@ -0,0 +1,56 @@
+package crypt
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMasterKey(t *testing.T) {
+	assert := assert.New(t)
+	passphrase := []byte("super secret 🍣")
+
+	key, header, err := NewMasterKey(passphrase)
+	assert.NoError(err)
+	assert.Len(key, MasterKeySize)
+	assert.NotEqual(passphrase, key)
+	t.Log(string(header))
+
+	parsed, err := ParseMasterKey(passphrase, header)
+	assert.NoError(err)
+	assert.Equal(key, parsed)
+	_, err = ParseMasterKey([]byte("not the passphrase"), header)
+	assert.Equal(ErrCorruptedMessage, err)
+
+	other, _, err := NewMasterKey(passphrase)
+	assert.NoError(err)
+	assert.NotEqual(key, other, "salt should change the key")
+}
+
+func TestMasterKeyHeader(t *testing.T) {
+	assert := assert.New(t)
+	passphrase := []byte("super secret 🍣")
+	_, header, err := NewMasterKey(passphrase)
+	assert.NoError(err)
+
+	tamper := func(f func(h *jsonMasterKeyHeader)) []byte {
+		var h jsonMasterKeyHeader
+		assert.NoError(json.Unmarshal(header, &h))
+		f(&h)
+		tampered, err := json.Marshal(h)
+		assert.NoError(err)
+		return tampered
+	}
+	_, err = ParseMasterKey(passphrase, tamper(func(h *jsonMasterKeyHeader) { h.Salt[0] ^= 1 }))
+	assert.Equal(ErrCorruptedMessage, err)
+	_, err = ParseMasterKey(passphrase, tamper(func(h *jsonMasterKeyHeader) { h.P = 2 }))
+	assert.Equal(ErrCorruptedMessage, err)
+	// Costs are checked before running the KDF
+	_, err = ParseMasterKey(passphrase, tamper(func(h *jsonMasterKeyHeader) { h.N = 1 << 30 }))
+	assert.Equal(ErrCorruptedMessage, err)
+	_, err = ParseMasterKey(passphrase, tamper(func(h *jsonMasterKeyHeader) { h.KDF = "md5" }))
+	assert.Equal(ErrUnsupportedKDF, err)
+	_, err = ParseMasterKey(passphrase, tamper(func(h *jsonMasterKeyHeader) { h.Version = 42 }))
+	assert.Equal(ErrUnsuportedVersion, err)
+}
@@ -0,0 +1,77 @@
+package crypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base32"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const nameIVSize = 16
+
+// nameEncoding is case insensitive so encrypted names can live on any filesystem
+var nameEncoding = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+// NameCipher deterministically encrypts names, SIV style: the IV is a MAC of
+// the name so the same name always gives the same encrypted name (which keeps
+// listing and diffing possible) and it authenticates the name on decryption.
+// An encrypted name is about 1.6 times longer than the name plus 26 characters,
+// so names over about 140 bytes don't fit in the 255 most filesystems allow
+type NameCipher struct {
+	block  cipher.Block
+	macKey []byte
+}
+
+// NewNameCipher returns a NameCipher whose keys are derived from key, a
+// random or master key (see NewMasterKey), not a passphrase
+func NewNameCipher(key []byte) (*NameCipher, error) {
+	keys := make([]byte, 64)
+	_, err := io.ReadFull(hkdf.New(sha256.New, key, nil, []byte("tri names")), keys)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(keys[:32])
+	if err != nil {
+		return nil, err
+	}
+	return &NameCipher{
+		block:  block,
+		macKey: keys[32:],
+	}, nil
+}
+
+func (c *NameCipher) iv(name []byte) []byte {
+	mac := hmac.New(sha256.New, c.macKey)
+	mac.Write(name)
+	return mac.Sum(nil)[:nameIVSize]
+}
+
+// Encrypt returns the encrypted name, it only contains [0-9a-v]
+func (c *NameCipher) Encrypt(name string) string {
+	encrypted := make([]byte, nameIVSize+len(name))
+	iv := c.iv([]byte(name))
+	copy(encrypted, iv)
+	cipher.NewCTR(c.block, iv).XORKeyStream(encrypted[nameIVSize:], []byte(name))
+	return strings.ToLower(nameEncoding.EncodeToString(encrypted))
+}
+
+// Decrypt returns the name encrypted with Encrypt. It returns
+// ErrCorruptedMessage if it was not encrypted with the same key
+func (c *NameCipher) Decrypt(encrypted string) (string, error) {
+	raw, err := nameEncoding.DecodeString(strings.ToUpper(encrypted))
+	if err != nil || len(raw) < nameIVSize {
+		return "", ErrCorruptedMessage
+	}
+	iv := raw[:nameIVSize]
+	name := make([]byte, len(raw)-nameIVSize)
+	cipher.NewCTR(c.block, iv).XORKeyStream(name, raw[nameIVSize:])
+	if !hmac.Equal(iv, c.iv(name)) {
+		return "", ErrCorruptedMessage
+	}
+	return string(name), nil
+}
@@ -0,0 +1,45 @@
+package crypt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNameEncryptDecrypt(t *testing.T) {
+	assert := assert.New(t)
+	c, err := NewNameCipher([]byte("super secret 🍣"))
+	assert.NoError(err)
+
+	for _, name := range []string{"", "a", "file_a", "Hello World! 🍣.txt"} {
+		encrypted := c.Encrypt(name)
+		assert.Regexp("^[0-9a-v]+$", encrypted)
+		assert.NotEqual(name, encrypted)
+		assert.Equal(encrypted, c.Encrypt(name), "encryption should be deterministic")
+		decrypted, err := c.Decrypt(encrypted)
+		assert.NoError(err)
+		assert.Equal(name, decrypted)
+	}
+	assert.NotEqual(c.Encrypt("file_a"), c.Encrypt("file_b"))
+}
+
+func TestNameDecryptErrors(t *testing.T) {
+	assert := assert.New(t)
+	c, err := NewNameCipher([]byte("super secret 🍣"))
+	assert.NoError(err)
+	other, err := NewNameCipher([]byte("not the key"))
+	assert.NoError(err)
+
+	_, err = other.Decrypt(c.Encrypt("file_a"))
+	assert.Equal(ErrCorruptedMessage, err)
+	_, err = c.Decrypt("file_a") // Not encrypted
+	assert.Equal(ErrCorruptedMessage, err)
+	encrypted := []byte(c.Encrypt("file_a"))
+	if encrypted[5] == '0' {
+		encrypted[5] = '1'
+	} else {
+		encrypted[5] = '0'
+	}
+	_, err = c.Decrypt(string(encrypted))
+	assert.Equal(ErrCorruptedMessage, err)
+}
@@ -0,0 +1,150 @@
+package crypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+)
+
+const (
+	// PrivateKeyVersion is the versioning of the Marshaling/Unmarshaling of the private key
+	PrivateKeyVersion = 1
+
+	privateKeyKDF = "scrypt"
+)
+
+// jsonPrivateKeyHeader is stored in clear and authenticated with the payload
+type jsonPrivateKeyHeader struct {
+	Version int    `json:"version"`
+	KDF     string `json:"kdf"`
+	Salt    []byte `json:"salt"`
+	ScryptParams
+}
+
+type jsonPrivateKey struct {
+	jsonPrivateKeyHeader
+	// Payload is the nonce followed by the encrypted jsonPrivateKeyPayload
+	Payload []byte `json:"payload"`
+}
+
+type jsonPrivateKeyPayload struct {
+	AsymPrivKey []byte  `json:"priv_key"`
+	AsymPubKey  []byte  `json:"pub_key"`
+	KeyLength   int     `json:"key_length"`
+	Name        []byte  `json:"name"`
+	KeyType     KeyType `json:"key_type,omitempty"`
+}
+
+// privateKeyAEAD returns the AEAD protecting a private key with password
+func privateKeyAEAD(password string, h jsonPrivateKeyHeader) (cipher.AEAD, error) {
+	if h.KDF != privateKeyKDF {
+		return nil, ErrUnsupportedKDF
+	}
+	if len(h.Salt) == 0 {
+		return nil, ErrCorruptedMessage
+	}
+	params := KDFParams{KDF: KDFScrypt, Salt: h.Salt, Scrypt: h.ScryptParams}
+	aesKey, err := params.DeriveKey([]byte(password), 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Marshal returns a bytes blob representing a private key, protected by
+// password. The key is derived from password with scrypt, the KDF and its
+// parameters are stored in an authenticated header
+func (priv *PrivateKey) Marshal(password string) ([]byte, error) {
+	header := jsonPrivateKeyHeader{
+		Version:      PrivateKeyVersion,
+		KDF:          privateKeyKDF,
+		Salt:         make([]byte, DefaultSaltSize),
+		ScryptParams: DefaultScryptParams,
+	}
+	if _, err := io.ReadFull(rand.Reader, header.Salt); err != nil {
+		return nil, err
+	}
+	aead, err := privateKeyAEAD(password, header)
+	if err != nil {
+		return nil, err
+	}
+	additional, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := json.Marshal(jsonPrivateKeyPayload{
+		AsymPrivKey: priv.AsymPrivKey,
+		AsymPubKey:  priv.PubKey.AsymPubKey,
+		KeyLength:   priv.PubKey.KeyLength,
+		Name:        priv.PubKey.Name,
+		KeyType:     priv.PubKey.keyType(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return json.Marshal(jsonPrivateKey{
+		jsonPrivateKeyHeader: header,
+		Payload:              aead.Seal(nonce, nonce, payload, additional),
+	})
+}
+
+// IsPrivateKey returns whether src looks like a marshalled private key: a
+// versioned envelope with a KDF and an encrypted payload. The version itself
+// is checked by ParsePrivateKey
+func IsPrivateKey(src []byte) bool {
+	var j jsonPrivateKey
+	return json.Unmarshal(src, &j) == nil && j.Version > 0 && j.KDF != "" && len(j.Payload) > 0
+}
+
+// ParsePrivateKey parses a json decription of your private key. It returns
+// ErrCorruptedMessage if the password is wrong or the key was tampered with
+func ParsePrivateKey(password string, src []byte) (PrivateKey, error) {
+	var j jsonPrivateKey
+	err := json.Unmarshal(src, &j)
+	if err != nil {
+		return PrivateKey{}, err
+	}
+	if j.Version != PrivateKeyVersion {
+		return PrivateKey{}, ErrUnsuportedVersion
+	}
+
+	aead, err := privateKeyAEAD(password, j.jsonPrivateKeyHeader)
+	if err != nil {
+		return PrivateKey{}, err
+	}
+	additional, err := json.Marshal(j.jsonPrivateKeyHeader)
+	if err != nil {
+		return PrivateKey{}, err
+	}
+	if len(j.Payload) < aead.NonceSize() {
+		return PrivateKey{}, ErrCorruptedMessage
+	}
+	nonce := j.Payload[:aead.NonceSize()]
+	plain, err := aead.Open(nil, nonce, j.Payload[aead.NonceSize():], additional)
+	if err != nil {
+		return PrivateKey{}, ErrCorruptedMessage
+	}
+	payload := jsonPrivateKeyPayload{KeyType: KeyTypeRSA} // Payloads without type are RSA keys
+	if err = json.Unmarshal(plain, &payload); err != nil {
+		return PrivateKey{}, err
+	}
+	return PrivateKey{
+		AsymPrivKey: payload.AsymPrivKey,
+		PubKey: PublicKey{
+			AsymPubKey: payload.AsymPubKey,
+			KeyLength:  payload.KeyLength,
+			Name:       payload.Name,
+			Type:       payload.KeyType,
+		},
+	}, nil
+}
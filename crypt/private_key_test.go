@@ -0,0 +1,75 @@
+package crypt
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testPrivateKey returns a private key that is not a real RSA key,
+// serialization doesn't care and it is much faster
+func testPrivateKey() PrivateKey {
+	return PrivateKey{
+		AsymPrivKey: []byte("private key 🍣"),
+		PubKey: PublicKey{
+			AsymPubKey: []byte("public key 🍣"),
+			KeyLength:  256,
+			Name:       []byte("testing"),
+			Type:       KeyTypeRSA,
+		},
+	}
+}
+
+func TestPrivateMarshaling(t *testing.T) {
+	assert := assert.New(t)
+	password := "super secret"
+	key := testPrivateKey()
+	marshalled, err := key.Marshal(password)
+	assert.NoError(err)
+	assert.True(IsPrivateKey(marshalled))
+	assert.NotContains(string(marshalled), "testing")
+	t.Log(string(marshalled))
+
+	unmarshalled, err := ParsePrivateKey(password, marshalled)
+	assert.NoError(err)
+	assert.Equal(key, unmarshalled)
+
+	_, err = ParsePrivateKey("not the password", marshalled)
+	assert.Equal(ErrCorruptedMessage, err)
+
+	// Public keys and the old unversioned format are not private keys
+	public, err := key.PubKey.Marshal(password)
+	assert.NoError(err)
+	assert.False(IsPrivateKey(public))
+	assert.False(IsPrivateKey([]byte(`{"priv_key":"cHJpdmF0ZQ==","pub_key":"cHVibGlj"}`)))
+}
+
+func TestPrivateMarshalingHeader(t *testing.T) {
+	assert := assert.New(t)
+	password := "super secret"
+	key := testPrivateKey()
+	marshalled, err := key.Marshal(password)
+	assert.NoError(err)
+
+	tamper := func(f func(j *jsonPrivateKey)) []byte {
+		var j jsonPrivateKey
+		assert.NoError(json.Unmarshal(marshalled, &j))
+		f(&j)
+		tampered, err := json.Marshal(j)
+		assert.NoError(err)
+		return tampered
+	}
+	// The header is authenticated
+	_, err = ParsePrivateKey(password, tamper(func(j *jsonPrivateKey) { j.P = 2 }))
+	assert.Equal(ErrCorruptedMessage, err)
+	_, err = ParsePrivateKey(password, tamper(func(j *jsonPrivateKey) { j.Salt[0] ^= 1 }))
+	assert.Equal(ErrCorruptedMessage, err)
+	// And checked before running an expensive KDF
+	_, err = ParsePrivateKey(password, tamper(func(j *jsonPrivateKey) { j.N = 1 << 30 }))
+	assert.Equal(ErrCorruptedMessage, err)
+	_, err = ParsePrivateKey(password, tamper(func(j *jsonPrivateKey) { j.KDF = "md5" }))
+	assert.Equal(ErrUnsupportedKDF, err)
+	_, err = ParsePrivateKey(password, tamper(func(j *jsonPrivateKey) { j.Version = 42 }))
+	assert.Equal(ErrUnsuportedVersion, err)
+}
@@ -0,0 +1,244 @@
+package crypt
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// StreamChunkSize is the size of the plain text chunks of the stream format
+	StreamChunkSize = 64 * 1024
+	// StreamHeaderSize is the size of the header of the stream format:
+	// version and salt
+	StreamHeaderSize = 1 + streamSaltSize
+
+	streamVersion  = 1
+	streamSaltSize = 16
+	streamTagSize  = 16
+)
+
+var (
+	// ErrUnsupportedStream is returned when the stream header is not one we can handle
+	ErrUnsupportedStream = errors.New("unsupported stream version")
+	// ErrStreamClosed is returned when writing to a closed stream
+	ErrStreamClosed = errors.New("stream is closed")
+)
+
+// streamAEAD returns the AEAD of a single stream. Each stream has its own key
+// derived from key and the stream salt, so nonces can simply be a counter.
+// key has to be a random or master key (see NewMasterKey), not a passphrase
+func streamAEAD(key, salt []byte) (cipher.AEAD, error) {
+	streamKey := make([]byte, 32)
+	_, err := io.ReadFull(hkdf.New(sha256.New, key, salt, []byte("tri stream")), streamKey)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(streamKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// streamNonce returns the nonce of a chunk: its counter and whether it is
+// the last one, so truncating or reordering the chunks is detected
+func streamNonce(nonce []byte, counter uint64, final bool) []byte {
+	for i := range nonce {
+		nonce[i] = 0
+	}
+	binary.BigEndian.PutUint64(nonce[3:11], counter)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// StreamCiphertextSize returns the size of the encrypted stream of size plain bytes
+func StreamCiphertextSize(size int64) int64 {
+	chunks := (size + StreamChunkSize - 1) / StreamChunkSize
+	if chunks == 0 { // There is always a final chunk
+		chunks = 1
+	}
+	return StreamHeaderSize + size + chunks*streamTagSize
+}
+
+// StreamPlaintextSize returns the size of the plain text of an encrypted stream
+// of size bytes. It returns 0 if size is too small to be a stream
+func StreamPlaintextSize(size int64) int64 {
+	size -= StreamHeaderSize
+	if size < streamTagSize {
+		return 0
+	}
+	chunks := (size + StreamChunkSize + streamTagSize - 1) / (StreamChunkSize + streamTagSize)
+	return size - chunks*streamTagSize
+}
+
+// streamEncrypter implements io.WriteCloser, see NewStreamEncrypter
+type streamEncrypter struct {
+	aead    cipher.AEAD
+	buffer  []byte
+	closed  bool
+	counter uint64
+	dst     io.WriteCloser
+	nonce   []byte
+	sealed  []byte
+}
+
+// NewStreamEncrypter returns a writer encrypting what is written to it to dst
+// in chunks of StreamChunkSize. Format is version / salt / chunks, each
+// chunk being authenticated with its position and whether it is the last one.
+// Closing it writes the last chunk and closes dst
+func NewStreamEncrypter(key []byte, dst io.WriteCloser) (io.WriteCloser, error) {
+	header := make([]byte, StreamHeaderSize)
+	header[0] = streamVersion
+	if _, err := io.ReadFull(rand.Reader, header[1:]); err != nil {
+		return nil, err
+	}
+	aead, err := streamAEAD(key, header[1:])
+	if err != nil {
+		return nil, err
+	}
+	if _, err = dst.Write(header); err != nil {
+		return nil, err
+	}
+	return &streamEncrypter{
+		aead:   aead,
+		buffer: make([]byte, 0, StreamChunkSize),
+		dst:    dst,
+		nonce:  make([]byte, aead.NonceSize()),
+		sealed: make([]byte, 0, StreamChunkSize+streamTagSize),
+	}, nil
+}
+
+// seal encrypts and writes the buffered chunk
+func (s *streamEncrypter) seal(final bool) error {
+	s.sealed = s.aead.Seal(s.sealed[:0], streamNonce(s.nonce, s.counter, final), s.buffer, nil)
+	s.counter++
+	s.buffer = s.buffer[:0]
+	_, err := s.dst.Write(s.sealed)
+	return err
+}
+
+func (s *streamEncrypter) Write(p []byte) (n int, err error) {
+	if s.closed {
+		return 0, ErrStreamClosed
+	}
+	for len(p) > 0 {
+		// Only seal a full chunk once we know it is not the last one
+		if len(s.buffer) == StreamChunkSize {
+			if err = s.seal(false); err != nil {
+				return n, err
+			}
+		}
+		written := copy(s.buffer[len(s.buffer):StreamChunkSize], p)
+		s.buffer = s.buffer[:len(s.buffer)+written]
+		p = p[written:]
+		n += written
+	}
+	return n, nil
+}
+
+func (s *streamEncrypter) Close() error {
+	if s.closed { // Already closed
+		return nil
+	}
+	s.closed = true
+	err := s.seal(true)
+	err2 := s.dst.Close()
+	if err != nil {
+		return err
+	}
+	return err2
+}
+
+// streamDecrypter implements io.ReadCloser, see NewStreamDecrypter
+type streamDecrypter struct {
+	aead    cipher.AEAD
+	counter uint64
+	done    bool
+	err     error
+	nonce   []byte
+	plain   []byte
+	r       *bufio.Reader
+	sealed  []byte
+	src     io.ReadCloser
+}
+
+// NewStreamDecrypter returns a reader decrypting src, encrypted by
+// NewStreamEncrypter. Read returns ErrCorruptedMessage as soon as a chunk
+// was tampered with, or if the stream was truncated. Closing it closes src
+func NewStreamDecrypter(key []byte, src io.ReadCloser) (io.ReadCloser, error) {
+	header := make([]byte, StreamHeaderSize)
+	if _, err := io.ReadFull(src, header); err != nil {
+		return nil, ErrCorruptedMessage
+	}
+	if header[0] != streamVersion {
+		return nil, ErrUnsupportedStream
+	}
+	aead, err := streamAEAD(key, header[1:])
+	if err != nil {
+		return nil, err
+	}
+	return &streamDecrypter{
+		aead:   aead,
+		nonce:  make([]byte, aead.NonceSize()),
+		r:      bufio.NewReaderSize(src, StreamChunkSize+streamTagSize+1),
+		sealed: make([]byte, StreamChunkSize+streamTagSize),
+		src:    src,
+	}, nil
+}
+
+// open reads and decrypts the next chunk
+func (s *streamDecrypter) open() error {
+	n, err := io.ReadFull(s.r, s.sealed)
+	final := false
+	switch err {
+	case nil:
+		// Full chunk, it is the last one if nothing follows
+		if _, err = s.r.Peek(1); err == io.EOF {
+			final = true
+		} else if err != nil {
+			return err
+		}
+	case io.ErrUnexpectedEOF:
+		final = true
+	case io.EOF: // The final chunk is missing
+		return ErrCorruptedMessage
+	default:
+		return err
+	}
+	s.plain, err = s.aead.Open(s.sealed[:0], streamNonce(s.nonce, s.counter, final), s.sealed[:n], nil)
+	if err != nil {
+		return ErrCorruptedMessage
+	}
+	s.counter++
+	s.done = final
+	return nil
+}
+
+func (s *streamDecrypter) Read(p []byte) (n int, err error) {
+	for len(s.plain) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		if s.done {
+			return 0, io.EOF
+		}
+		s.err = s.open()
+	}
+	n = copy(p, s.plain)
+	s.plain = s.plain[n:]
+	return n, nil
+}
+
+func (s *streamDecrypter) Close() error {
+	return s.src.Close()
+}
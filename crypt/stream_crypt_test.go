@@ -0,0 +1,120 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// bufferCloser is a bytes.Buffer with a no-op Close
+type bufferCloser struct {
+	bytes.Buffer
+}
+
+func (b *bufferCloser) Close() error { return nil }
+
+func streamEncrypt(t *testing.T, key, data []byte) []byte {
+	var out bufferCloser
+	w, err := NewStreamEncrypter(key, &out)
+	if err != nil {
+		t.Fatalf("Failed to create encrypter: %s", err)
+	}
+	// Write in odd sizes to exercise the chunking
+	for len(data) > 0 {
+		n := 1000
+		if n > len(data) {
+			n = len(data)
+		}
+		if _, err = w.Write(data[:n]); err != nil {
+			t.Fatalf("Failed to write: %s", err)
+		}
+		data = data[n:]
+	}
+	if err = w.Close(); err != nil {
+		t.Fatalf("Failed to close: %s", err)
+	}
+	return out.Bytes()
+}
+
+func streamDecrypt(key, encrypted []byte) ([]byte, error) {
+	r, err := NewStreamDecrypter(key, ioutil.NopCloser(bytes.NewReader(encrypted)))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func TestStreamEncryptDecrypt(t *testing.T) {
+	assert := assert.New(t)
+	key := []byte("super secret 🍣")
+	for _, size := range []int{0, 1, StreamChunkSize - 1, StreamChunkSize, StreamChunkSize + 1, 3 * StreamChunkSize} {
+		data := make([]byte, size)
+		_, err := io.ReadFull(rand.Reader, data)
+		assert.NoError(err)
+
+		encrypted := streamEncrypt(t, key, data)
+		assert.Equal(StreamCiphertextSize(int64(size)), int64(len(encrypted)), "size %d", size)
+		assert.Equal(int64(size), StreamPlaintextSize(int64(len(encrypted))), "size %d", size)
+
+		decrypted, err := streamDecrypt(key, encrypted)
+		assert.NoError(err, "size %d", size)
+		assert.True(bytes.Equal(data, decrypted), "size %d", size)
+
+		_, err = streamDecrypt([]byte("not the key"), encrypted)
+		assert.Equal(ErrCorruptedMessage, err, "size %d", size)
+	}
+}
+
+func TestStreamTampering(t *testing.T) {
+	assert := assert.New(t)
+	key := []byte("super secret 🍣")
+	data := make([]byte, 3*StreamChunkSize)
+	encrypted := streamEncrypt(t, key, data)
+	chunk := StreamChunkSize + streamTagSize
+
+	// Truncated at a chunk boundary
+	_, err := streamDecrypt(key, encrypted[:StreamHeaderSize+2*chunk])
+	assert.Equal(ErrCorruptedMessage, err)
+	// Truncated in the middle of a chunk
+	_, err = streamDecrypt(key, encrypted[:len(encrypted)-10])
+	assert.Equal(ErrCorruptedMessage, err)
+
+	// Reordered chunks
+	reordered := make([]byte, 0, len(encrypted))
+	reordered = append(reordered, encrypted[:StreamHeaderSize]...)
+	reordered = append(reordered, encrypted[StreamHeaderSize+chunk:StreamHeaderSize+2*chunk]...)
+	reordered = append(reordered, encrypted[StreamHeaderSize:StreamHeaderSize+chunk]...)
+	reordered = append(reordered, encrypted[StreamHeaderSize+2*chunk:]...)
+	_, err = streamDecrypt(key, reordered)
+	assert.Equal(ErrCorruptedMessage, err)
+
+	// Modified content
+	modified := append([]byte{}, encrypted...)
+	modified[StreamHeaderSize+10] ^= 1
+	_, err = streamDecrypt(key, modified)
+	assert.Equal(ErrCorruptedMessage, err)
+
+	// Unknown version
+	modified = append([]byte{}, encrypted...)
+	modified[0] = 42
+	_, err = streamDecrypt(key, modified)
+	assert.Equal(ErrUnsupportedStream, err)
+}
+
+func BenchmarkStreamEncrypt(b *testing.B) {
+	if raw == nil {
+		b.Fatal(ErrNoPayloadEnv)
+	}
+	b.SetBytes(int64(len(raw)))
+	key := []byte("super secret 🍣")
+	for i := 0; i < b.N; i++ {
+		w, _ := NewStreamEncrypter(key, &bufferCloser{})
+		w.Write(raw)
+		w.Close()
+	}
+}
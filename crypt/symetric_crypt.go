@@ -1,6 +1,7 @@
 package crypt
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
@@ -12,16 +13,102 @@ import (
 	"golang.org/x/crypto/pbkdf2"
 )
 
+const (
+	// SymetricVersion is the versioning of the SymetricEncrypt envelope
+	SymetricVersion = 2
+)
+
 var (
 	// ErrCorruptedMessage is returned when the encrypted input is incorrect
 	ErrCorruptedMessage = errors.New("encrypted message seems corrupted")
 	encoding            = binary.LittleEndian
+	// symetricMagic starts the envelope since version 2. Version 1 has no
+	// header and starts with the nonce size (12) so it can't be mistaken for it
+	symetricMagic = []byte{'T', 'R', 'I', SymetricVersion}
 )
 
 // SymetricEncrypt encrypts the plain byte with the give key. It produces random IV that
-// gets written to the output
+// gets written to the output. The AES key is derived from key with DefaultKDFParams
 func SymetricEncrypt(key, dst, src []byte) ([]byte, error) {
-	aesKey := pbkdf2.Key(key, nil, 3, 32, sha256.New)
+	params, err := DefaultKDFParams()
+	if err != nil {
+		return nil, err
+	}
+	return SymetricEncryptWithKDF(key, dst, src, params)
+}
+
+// marshalKDFHeader returns the envelope header: magic / kdf / salt size / salt / kdf parameters
+func marshalKDFHeader(params KDFParams) ([]byte, error) {
+	if len(params.Salt) > 255 {
+		return nil, errors.New("salt is too long")
+	}
+	header := bytes.NewBuffer(append([]byte{}, symetricMagic...))
+	header.WriteByte(byte(params.KDF))
+	header.WriteByte(byte(len(params.Salt)))
+	header.Write(params.Salt)
+	switch params.KDF {
+	case KDFPBKDF2SHA256:
+		binary.Write(header, encoding, uint32(params.Iterations))
+	case KDFScrypt:
+		binary.Write(header, encoding, uint32(params.Scrypt.N))
+		binary.Write(header, encoding, uint32(params.Scrypt.R))
+		binary.Write(header, encoding, uint32(params.Scrypt.P))
+	default:
+		return nil, ErrUnsupportedKDF
+	}
+	return header.Bytes(), nil
+}
+
+// parseKDFHeader parses the header written by marshalKDFHeader and returns
+// the parameters and the size of the header
+func parseKDFHeader(src []byte) (KDFParams, int, error) {
+	r := bytes.NewReader(src[len(symetricMagic):])
+	var params KDFParams
+	kdf, err := r.ReadByte()
+	if err != nil {
+		return KDFParams{}, 0, ErrCorruptedMessage
+	}
+	params.KDF = KDF(kdf)
+	saltSize, err := r.ReadByte()
+	if err != nil {
+		return KDFParams{}, 0, ErrCorruptedMessage
+	}
+	params.Salt = make([]byte, saltSize)
+	if _, err = io.ReadFull(r, params.Salt); err != nil {
+		return KDFParams{}, 0, ErrCorruptedMessage
+	}
+	var values []uint32
+	switch params.KDF {
+	case KDFPBKDF2SHA256:
+		values = make([]uint32, 1)
+	case KDFScrypt:
+		values = make([]uint32, 3)
+	default:
+		return KDFParams{}, 0, ErrUnsupportedKDF
+	}
+	if err = binary.Read(r, encoding, values); err != nil {
+		return KDFParams{}, 0, ErrCorruptedMessage
+	}
+	if params.KDF == KDFPBKDF2SHA256 {
+		params.Iterations = int(values[0])
+	} else {
+		params.Scrypt = ScryptParams{N: int(values[0]), R: int(values[1]), P: int(values[2])}
+	}
+	return params, len(src) - r.Len(), nil
+}
+
+// SymetricEncryptWithKDF is SymetricEncrypt with the AES key derived from
+// key with params. Format is header (magic / kdf / salt / kdf parameters) /
+// nonce size / nonce / encrypted, the header being authenticated
+func SymetricEncryptWithKDF(key, dst, src []byte, params KDFParams) ([]byte, error) {
+	header, err := marshalKDFHeader(params)
+	if err != nil {
+		return nil, err
+	}
+	aesKey, err := params.DeriveKey(key, 32)
+	if err != nil {
+		return nil, err
+	}
 	block, err := aes.NewCipher(aesKey)
 	if err != nil {
 		return nil, err
@@ -36,17 +123,35 @@ func SymetricEncrypt(key, dst, src []byte) ([]byte, error) {
 	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
 		return nil, err
 	}
-	encrypted := aead.Seal(dst[:0], nonce, src, nil)
-	// Format is nonce size / nonce / encrypted
-	result := make([]byte, 4+len(nonce)+len(encrypted))
-	encoding.PutUint32(result[0:4], uint32(nonceSize))
-	copy(result[4:4+nonceSize], nonce)
-	copy(result[4+nonceSize:], encrypted)
+	encrypted := aead.Seal(dst[:0], nonce, src, header)
+	result := make([]byte, len(header)+4+len(nonce)+len(encrypted))
+	copy(result, header)
+	encoding.PutUint32(result[len(header):len(header)+4], uint32(nonceSize))
+	copy(result[len(header)+4:len(header)+4+nonceSize], nonce)
+	copy(result[len(header)+4+nonceSize:], encrypted)
 	return result, nil
 }
 
-// SymetricDecrypt decrypts the encrypted key with the key
+// SymetricDecrypt decrypts the encrypted key with the key. It can decrypt both
+// the current envelope and the version 1 one (nonce size / nonce / encrypted,
+// with a key derived without salt)
 func SymetricDecrypt(key, dst, src []byte) ([]byte, error) {
+	var aesKey, header []byte
+	if bytes.HasPrefix(src, symetricMagic) {
+		params, headerSize, err := parseKDFHeader(src)
+		if err != nil {
+			return nil, err
+		}
+		aesKey, err = params.DeriveKey(key, 32)
+		if err != nil {
+			return nil, err
+		}
+		header = src[:headerSize]
+		src = src[headerSize:]
+	} else { // Version 1
+		aesKey = pbkdf2.Key(key, nil, 3, 32, sha256.New)
+	}
+
 	if len(src) < 4 { // We can't even get nonce size
 		return nil, ErrCorruptedMessage
 	}
@@ -55,7 +160,6 @@ func SymetricDecrypt(key, dst, src []byte) ([]byte, error) {
 		return nil, ErrCorruptedMessage
 	}
 	nonce := src[4 : 4+nonceSize]
-	aesKey := pbkdf2.Key(key, nil, 3, 32, sha256.New)
 	block, err := aes.NewCipher(aesKey)
 	if err != nil {
 		return nil, err
@@ -64,5 +168,5 @@ func SymetricDecrypt(key, dst, src []byte) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	return aead.Open(dst[:0], nonce, src[4+nonceSize:], nil)
+	return aead.Open(dst[:0], nonce, src[4+nonceSize:], header)
 }
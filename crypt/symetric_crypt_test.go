@@ -1,6 +1,9 @@
 package crypt
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -8,6 +11,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/pbkdf2"
 )
 
 var raw []byte
@@ -80,3 +84,55 @@ func BenchmarkSymetricDecrypt(b *testing.B) {
 		SymetricDecrypt(key, nil, encrypted)
 	}
 }
+
+func TestEncryptDecryptWithKDF(t *testing.T) {
+	assert := assert.New(t)
+	data := []byte("Hello World! 🍣")
+	key := []byte("super secret 🍣")
+	params := KDFParams{KDF: KDFPBKDF2SHA256, Salt: []byte("salt"), Iterations: 1000}
+	encrypted, err := SymetricEncryptWithKDF(key, nil, data, params)
+	assert.NoError(err)
+	decrypted, err := SymetricDecrypt(key, nil, encrypted)
+	assert.NoError(err)
+	assert.Equal(data, decrypted)
+
+	// The same input gives different outputs thanks to the salt
+	encrypted1, err := SymetricEncrypt(key, nil, data)
+	assert.NoError(err)
+	encrypted2, err := SymetricEncrypt(key, nil, data)
+	assert.NoError(err)
+	assert.NotEqual(encrypted1[:len(symetricMagic)+2+DefaultSaltSize], encrypted2[:len(symetricMagic)+2+DefaultSaltSize])
+
+	// The header is authenticated
+	tampered := append([]byte{}, encrypted...)
+	tampered[len(symetricMagic)+2] ^= 1 // Salt
+	_, err = SymetricDecrypt(key, nil, tampered)
+	assert.Error(err)
+	tampered = append([]byte{}, encrypted...)
+	tampered[len(symetricMagic)] = 42 // KDF
+	_, err = SymetricDecrypt(key, nil, tampered)
+	assert.Equal(ErrUnsupportedKDF, err)
+	_, err = SymetricDecrypt(key, nil, encrypted[:len(symetricMagic)+3])
+	assert.Equal(ErrCorruptedMessage, err)
+}
+
+func TestDecryptVersion1(t *testing.T) {
+	assert := assert.New(t)
+	data := []byte("Hello World! 🍣")
+	key := []byte("super secret 🍣")
+
+	// Encrypt the way it was done before the KDF header
+	block, err := aes.NewCipher(pbkdf2.Key(key, nil, 3, 32, sha256.New))
+	assert.NoError(err)
+	aead, err := cipher.NewGCM(block)
+	assert.NoError(err)
+	nonce := make([]byte, aead.NonceSize())
+	encrypted := make([]byte, 4, 4+len(nonce))
+	encoding.PutUint32(encrypted, uint32(len(nonce)))
+	encrypted = append(encrypted, nonce...)
+	encrypted = aead.Seal(encrypted, nonce, data, nil)
+
+	decrypted, err := SymetricDecrypt(key, nil, encrypted)
+	assert.NoError(err)
+	assert.Equal(data, decrypted)
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/Viq111/tri/crypt"
+	"github.com/Viq111/tri/storage"
+)
+
+const (
+	// keysEnv is the environment variable overriding the keyring directory
+	keysEnv = "TRI_KEYS"
+	// keyPasswordEnv is the environment variable holding the key password,
+	// it is prompted for when not set
+	keyPasswordEnv = "TRI_KEY_PASSWORD"
+
+	publicKeyExt  = ".pub"
+	privateKeyExt = ".key"
+	keyFilePerms  = 0600
+)
+
+var keyOptions struct {
+	bits    int
+	keyType string
+	name    string
+	private bool
+	oldKey  string
+	newKey  string
+	// encryption of the destination of rotate, the same flags as sync
+	encryption encryptionOptions
+}
+
+// keyringDir returns the directory where keys are stored
+func keyringDir() string {
+	if dir := os.Getenv(keysEnv); dir != "" {
+		return dir
+	}
+	config, err := os.UserConfigDir()
+	if err != nil {
+		log.Fatalf("Failed to find the keyring directory, set $%s: %s\n", keysEnv, err)
+	}
+	return filepath.Join(config, "tri", "keys")
+}
+
+// readPassword returns the key password from the environment or the terminal
+func readPassword(prompt string, confirm bool) string {
+	if password, ok := os.LookupEnv(keyPasswordEnv); ok {
+		return password
+	}
+	fmt.Fprint(os.Stderr, prompt+": ")
+	password, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		log.Fatalf("Failed to read password (you can set $%s): %s\n", keyPasswordEnv, err)
+	}
+	if confirm {
+		fmt.Fprint(os.Stderr, "Confirm "+prompt+": ")
+		again, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			log.Fatalf("Failed to read password: %s\n", err)
+		}
+		if !bytes.Equal(password, again) {
+			log.Fatal("Passwords don't match")
+		}
+	}
+	return string(password)
+}
+
+// passwordOnce returns a function reading the key password, see readPassword,
+// the first time it is called only
+func passwordOnce(prompt string) func() string {
+	var password *string
+	return func() string {
+		if password == nil {
+			p := readPassword(prompt, false)
+			password = &p
+		}
+		return *password
+	}
+}
+
+// writeKeyFile writes a key file, it never overwrites an existing one
+func writeKeyFile(path string, content []byte) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, keyFilePerms)
+	if err != nil {
+		log.Fatalf("Failed to create key file: %s\n", err)
+	}
+	_, err = f.Write(content)
+	err2 := f.Close()
+	if err == nil {
+		err = err2
+	}
+	if err != nil {
+		log.Fatalf("Failed to write key file %s: %s\n", path, err)
+	}
+}
+
+// loadKey reads a key from a file, or from the keyring if nameOrPath is a
+// key name. priv is only set if a private key was found
+func loadKey(nameOrPath, password string) (pub crypt.PublicKey, priv *crypt.PrivateKey) {
+	paths := []string{
+		filepath.Join(keyringDir(), nameOrPath+privateKeyExt),
+		filepath.Join(keyringDir(), nameOrPath+publicKeyExt),
+		nameOrPath,
+	}
+	for _, path := range paths {
+		content, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			log.Fatalf("Failed to read key %s: %s\n", path, err)
+		}
+		if crypt.IsPrivateKey(content) {
+			key, err := crypt.ParsePrivateKey(password, content)
+			if err != nil {
+				log.Fatalf("Failed to open private key %s (wrong password?): %s\n", path, err)
+			}
+			return key.PubKey, &key
+		}
+		pub, err = crypt.ParsePublicKey(password, content)
+		if err != nil {
+			log.Fatalf("Failed to open public key %s (wrong password?): %s\n", path, err)
+		}
+		return pub, nil
+	}
+	log.Fatalf("Key %s not found in %s\n", nameOrPath, keyringDir())
+	return
+}
+
+// loadPublicKey reads a public key from a file, or from the keyring if
+// nameOrPath is a key name. The password is only read if the key is
+// protected by one, or if it is in a private key file
+func loadPublicKey(nameOrPath string, password func() string) crypt.PublicKey {
+	paths := []string{
+		filepath.Join(keyringDir(), nameOrPath+publicKeyExt),
+		nameOrPath,
+	}
+	for _, path := range paths {
+		content, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			log.Fatalf("Failed to read key %s: %s\n", path, err)
+		}
+		if crypt.IsPrivateKey(content) {
+			pub, _ := loadKey(path, password())
+			return pub
+		}
+		if pub, err := crypt.ParsePublicKey("", content); err == nil {
+			return pub
+		}
+		pub, err := crypt.ParsePublicKey(password(), content)
+		if err != nil {
+			log.Fatalf("Failed to open public key %s (wrong password?): %s\n", path, err)
+		}
+		return pub
+	}
+	log.Fatalf("Key %s not found in %s\n", nameOrPath, keyringDir())
+	return crypt.PublicKey{}
+}
+
+func runKey(args []string) {
+	keyCommand := flag.NewFlagSet("key", flag.ExitOnError)
+	keyCommand.BoolVar(&options.Verbose, "v", false, "Display INFO level log")
+	keyCommand.IntVar(&keyOptions.bits, "bits", crypt.DefaultBitsSize, "With generate, size of the RSA key")
+	keyCommand.StringVar(&keyOptions.keyType, "type", string(crypt.KeyTypeRSA), "With generate, type of the key: rsa or x25519 (much faster to generate)")
+	keyCommand.StringVar(&keyOptions.name, "name", "", "With import, name of the key in the keyring (default to the key name)")
+	keyCommand.BoolVar(&keyOptions.private, "private", false, "With export, export the private key instead of the public one")
+	keyCommand.StringVar(&keyOptions.oldKey, "old", "", "With rotate, the private key (key name or file) the backups are encrypted for")
+	keyCommand.StringVar(&keyOptions.newKey, "new", "", "With rotate, the public key (key name or file) to encrypt the backups for")
+	keyOptions.encryption.addFlags(keyCommand)
+	if len(args) == 0 {
+		log.Fatal("key should be followed by generate, export, import, info or rotate")
+	}
+	action := args[0]
+	keyCommand.Parse(args[1:])
+	if options.Verbose {
+		log.SetLevel(log.InfoLevel)
+	}
+
+	switch action {
+	case "generate":
+		if keyCommand.NArg() != 1 {
+			log.Fatal("key generate should be followed by <name>")
+		}
+		name := keyCommand.Arg(0)
+		dir := keyringDir()
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			log.Fatalf("Failed to create keyring %s: %s\n", dir, err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, name+privateKeyExt)); err == nil {
+			log.Fatalf("Key %s already exists\n", name)
+		}
+		password := readPassword("Key password", true)
+		keyType := crypt.KeyType(keyOptions.keyType)
+		if keyType == crypt.KeyTypeRSA {
+			log.Infof("Generating a %d bits key, this can take a while...", keyOptions.bits)
+		}
+		key, err := crypt.GenerateKey(keyType, name, keyOptions.bits)
+		if err != nil {
+			log.Fatalf("Failed to generate key: %s\n", err)
+		}
+		pub, err := key.PubKey.Marshal(password)
+		if err != nil {
+			log.Fatalf("Failed to marshal public key: %s\n", err)
+		}
+		priv, err := key.Marshal(password)
+		if err != nil {
+			log.Fatalf("Failed to marshal private key: %s\n", err)
+		}
+		writeKeyFile(filepath.Join(dir, name+publicKeyExt), pub)
+		writeKeyFile(filepath.Join(dir, name+privateKeyExt), priv)
+		printKeyInfo(key.PubKey, true)
+	case "export":
+		if keyCommand.NArg() != 2 {
+			log.Fatal("key export should be followed by <name> <file>")
+		}
+		pub, priv := loadKey(keyCommand.Arg(0), readPassword("Key password", false))
+		if keyOptions.private && priv == nil {
+			log.Fatalf("No private key for %s\n", keyCommand.Arg(0))
+		}
+		password := readPassword("Export password", true)
+		var content []byte
+		var err error
+		if keyOptions.private {
+			content, err = priv.Marshal(password)
+		} else {
+			content, err = pub.Marshal(password)
+		}
+		if err != nil {
+			log.Fatalf("Failed to marshal key: %s\n", err)
+		}
+		writeKeyFile(keyCommand.Arg(1), content)
+	case "import":
+		if keyCommand.NArg() != 1 {
+			log.Fatal("key import should be followed by <file>")
+		}
+		password := readPassword("Key password", false)
+		pub, priv := loadKey(keyCommand.Arg(0), password)
+		name := keyOptions.name
+		if name == "" {
+			name = string(pub.Name)
+		}
+		if name == "" {
+			log.Fatal("Key has no name, use -name")
+		}
+		dir := keyringDir()
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			log.Fatalf("Failed to create keyring %s: %s\n", dir, err)
+		}
+		content, err := pub.Marshal(password)
+		if err != nil {
+			log.Fatalf("Failed to marshal public key: %s\n", err)
+		}
+		writeKeyFile(filepath.Join(dir, name+publicKeyExt), content)
+		if priv != nil {
+			content, err = priv.Marshal(password)
+			if err != nil {
+				log.Fatalf("Failed to marshal private key: %s\n", err)
+			}
+			writeKeyFile(filepath.Join(dir, name+privateKeyExt), content)
+		}
+		printKeyInfo(pub, priv != nil)
+	case "info":
+		if keyCommand.NArg() != 1 {
+			log.Fatal("key info should be followed by <name|file>")
+		}
+		pub, priv := loadKey(keyCommand.Arg(0), readPassword("Key password", false))
+		printKeyInfo(pub, priv != nil)
+	case "rotate":
+		if keyCommand.NArg() != 1 || keyOptions.oldKey == "" || keyOptions.newKey == "" {
+			log.Fatal("key rotate should be followed by -old <name|file> -new <name|file> <dst>")
+		}
+		_, oldKey := loadKey(keyOptions.oldKey, readPassword("Old key password", false))
+		if oldKey == nil {
+			log.Fatalf("No private key for %s\n", keyOptions.oldKey)
+		}
+		newKey, _ := loadKey(keyOptions.newKey, readPassword("New key password", false))
+		dst := keyCommand.Arg(0)
+		dstStorage := openDestination(dst, keyOptions.encryption, false, false)
+		rotation, err := storage.RotateKey(dstStorage, *oldKey, newKey)
+		if err != nil {
+			log.Fatalf("Failed to rotate key of %s: %s\n", dst, err)
+		}
+		fmt.Printf("Re-wrapped %d data keys for %s (%d skipped)\n", rotation.Keys, rotation.New, rotation.Skipped)
+	default:
+		log.Fatalf("%s is not a valid key command.\n", action)
+	}
+}
+
+// printKeyInfo prints the details of a key
+func printKeyInfo(pub crypt.PublicKey, private bool) {
+	fmt.Printf("Name:        %s\n", pub.Name)
+	fmt.Printf("Type:        %s\n", pub.Type)
+	fmt.Printf("Bits:        %d\n", pub.KeyLength)
+	fmt.Printf("Fingerprint: %s\n", pub.Fingerprint())
+	fmt.Printf("Version:     %d\n", crypt.KeyVersion)
+	if private {
+		fmt.Printf("Private:     true (version %d)\n", crypt.PrivateKeyVersion)
+	} else {
+		fmt.Printf("Private:     false\n")
+	}
+}
@@ -4,10 +4,15 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"path"
+	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
+	"github.com/Viq111/tri/crypt"
 	"github.com/Viq111/tri/storage"
 )
 
@@ -22,8 +27,36 @@ var options struct {
 // tri <source> <dst> should backup all the files in source to dst.
 
 var syncOptions struct {
-	srcPath string
-	dstPath string
+	binKeepDays     int
+	binKeepLast     int
+	checksum        bool
+	continueOnError bool
+	dedup           bool
+	noIndex         bool
+	transfers       int
+	encryption      encryptionOptions
+}
+
+// exitPartial is the exit code of a sync that finished without some files
+const exitPartial = 3
+
+// passphraseEnv is the environment variable holding the encryption passphrase
+const passphraseEnv = "TRI_PASSPHRASE"
+
+var restoreOptions struct {
+	overwrite  bool
+	snapshot   string
+	encryption encryptionOptions
+}
+
+var snapshotsOptions struct {
+	encryption encryptionOptions
+}
+
+var binOptions struct {
+	encryptNames bool
+	keepDays     int
+	keepLast     int
 }
 
 func init() {
@@ -36,45 +69,473 @@ func init() {
 }
 
 func main() {
-	syncCommand := flag.NewFlagSet("sync", flag.ExitOnError)
-	syncCommand.BoolVar(&options.Verbose, "v", false, "Display INFO level log")
 	if len(os.Args) == 1 {
 		fmt.Printf(`usage: %s <command> [<args>]
 		Available commands:
-		  - sync <src> <dst> - Sync folder dst to mirror folder src
+		  - sync <src>... <dst> - Sync folder dst to mirror folder src, or store a deduplicated snapshot with -dedup.
+		    With several sources, each one is mirrored to dst/<name of the source>, its own destination for the other commands
+		    src, dst and the other locations are local paths or URLs of any backend, src can be read-only:
+		      - file:///path
+		      - s3://bucket/prefix, with the AWS_* credentials in the environment
+		      - sftp://user@host/path, logging in with the ssh-agent, ~/.ssh keys or $TRI_SFTP_PASSWORD
+		      - webdav[s]://user@host/path, with the password in $TRI_WEBDAV_PASSWORD
+		  - restore <backup> <target> [<path|glob>] - Restore the files of backup, or the ones matching path, to target
+		  - snapshots <dst> - List the snapshots of dst, saved by each sync that changed it, that can be restored with restore -snapshot
+		  - bin list <dst> [<generation>] - List the bin generations of dst, or the files in one
+		  - bin restore <dst> <generation> [<path>] - Move files back from the bin to dst
+		  - bin purge <dst> [<generation>] - Remove a generation, or the ones not kept by -keep-days/-keep-last, and the snapshots older than it
+		  - key generate <name> - Generate a key pair in the keyring
+		  - key export <name> <file> - Export a key of the keyring, protected by a new password
+		  - key import <file> - Import a key file to the keyring
+		  - key info <name|file> - Display the name, size and fingerprint of a key
+		  - key rotate -old <name|file> -new <name|file> <dst> - Re-wrap the data keys of dst for a new key, dst is opened with the encryption flags of sync
 		`, os.Args[0])
 		return
 	}
 	switch os.Args[1] {
 	case "sync":
-		syncCommand.Parse(os.Args[2:])
-		if options.Verbose {
-			log.SetLevel(log.InfoLevel)
+		runSync(os.Args[2:])
+	case "restore":
+		runRestore(os.Args[2:])
+	case "snapshots":
+		runSnapshots(os.Args[2:])
+	case "bin":
+		runBin(os.Args[2:])
+	case "key":
+		runKey(os.Args[2:])
+	default:
+		log.Fatalf("%s is not valid command.\n", os.Args[1])
+	}
+}
+
+// stringList is a flag that can be repeated
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// encryptionOptions select how a destination is encrypted
+type encryptionOptions struct {
+	encrypt      bool
+	encryptNames bool
+	recipients   stringList
+}
+
+func (e *encryptionOptions) addFlags(f *flag.FlagSet) {
+	f.BoolVar(&e.encrypt, "encrypt", false, "Encrypt the files in dst with the passphrase in $"+passphraseEnv)
+	f.BoolVar(&e.encryptNames, "encrypt-names", false, "Also encrypt the file and directory names with the passphrase in $"+passphraseEnv+" (implies -encrypt)")
+	f.Var(&e.recipients, "recipient", "Encrypt each file for this public key (key name or file) instead of the passphrase, can be repeated. sync only needs the public key, and only asks its password if it was exported with one")
+}
+
+// openDestination returns the storage at dst, encrypted as selected by e.
+// The master key of a passphrase is only created if create is set. With
+// recipients, their private keys are only loaded if private is set, writing
+// only needs the public ones
+func openDestination(dst string, e encryptionOptions, create, private bool) storage.Storage {
+	backend, err := storage.Open(dst)
+	if err != nil {
+		log.Fatalf("Failed to read destination %s: %s\n", dst, err)
+	}
+	if !e.encrypt && !e.encryptNames && len(e.recipients) == 0 {
+		return backend
+	}
+	var masterKey []byte
+	if e.encryptNames || len(e.recipients) == 0 {
+		masterKey, err = storage.MasterKey(backend, ".", []byte(os.Getenv(passphraseEnv)), create)
+		if err != nil {
+			log.Fatalf("Failed to derive the key of %s from the passphrase (is $%s set?): %s\n", dst, passphraseEnv, err)
 		}
-		nbArgs := syncCommand.NArg()
-		if nbArgs < 2 {
-			log.Fatal("sync should be followed by <src> <dst>")
+	}
+	var encrypted *storage.EncryptedStorage
+	if len(e.recipients) > 0 {
+		password := passwordOnce("Key password")
+		var recipients []crypt.PublicKey
+		var priv *crypt.PrivateKey
+		for _, r := range e.recipients {
+			if !private {
+				recipients = append(recipients, loadPublicKey(r, password))
+				continue
+			}
+			pub, p := loadKey(r, password())
+			recipients = append(recipients, pub)
+			if priv == nil {
+				priv = p
+			}
 		}
-		srcs := syncCommand.Args()[:nbArgs-1]
-		dst := syncCommand.Args()[nbArgs-1]
-		dstStorage, err := storage.NewLocalStorage(dst)
+		encrypted, err = storage.NewHybridEncryptedStorage(backend, recipients, priv)
+	} else {
+		encrypted, err = storage.NewEncryptedStorage(backend, masterKey)
+	}
+	if err == nil && e.encryptNames {
+		err = encrypted.EncryptNames(masterKey)
+	}
+	if err != nil {
+		log.Fatalf("Failed to encrypt destination: %s\n", err)
+	}
+	return encrypted
+}
+
+// openRepository returns the repository in s, creating it if create is set.
+// It returns nil if there is none
+func openRepository(s storage.Storage, create bool) *storage.Repository {
+	exists, err := storage.IsRepository(s, ".")
+	if err != nil {
+		log.Fatalf("Failed to read destination: %s\n", err)
+	}
+	if !exists && !create {
+		return nil
+	}
+	var repo *storage.Repository
+	if exists {
+		repo, err = storage.OpenRepository(s, ".")
+	} else {
+		repo, err = storage.InitRepository(s, ".", storage.DefaultChunkerParams)
+	}
+	if err != nil {
+		log.Fatalf("Failed to open repository: %s\n", err)
+	}
+	return repo
+}
+
+// checkRepositoryFlags exits if flags of sync that only apply to a mirror are
+// set, a backup to a repository would silently ignore them
+func checkRepositoryFlags(f *flag.FlagSet) {
+	var mirrorOnly []string
+	f.Visit(func(fl *flag.Flag) {
+		switch fl.Name {
+		case "bin-keep-days", "bin-keep-last", "checksum", "continue-on-error", "j":
+			mirrorOnly = append(mirrorOnly, "-"+fl.Name)
+		}
+	})
+	if len(mirrorOnly) > 0 {
+		log.Fatalf("%s can't be used with a repository (-dedup)\n", strings.Join(mirrorOnly, ", "))
+	}
+}
+
+// isURL returns whether location is a URL, opened by a registered backend,
+// instead of a local path
+func isURL(location string) bool {
+	return strings.Contains(location, "://")
+}
+
+// joinLocation returns the path of relative in the storage at location
+func joinLocation(location, relative string) string {
+	if isURL(location) {
+		return strings.TrimSuffix(location, "/") + "/" + path.Clean(relative)
+	}
+	return filepath.Join(location, relative)
+}
+
+// openIndex returns the local index of the destination dst encrypted as
+// selected by e, or nil if there is no cache directory. Each encryption has
+// its own index: the same files don't have the same tree in dst
+func openIndex(dst string, e encryptionOptions) *storage.Index {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		log.Infof("Not using an index: %s", err)
+		return nil
+	}
+	key := dst
+	if !isURL(dst) {
+		key, err = filepath.Abs(dst)
 		if err != nil {
 			log.Fatalf("Failed to read destination %s: %s\n", dst, err)
 		}
-		log.Infof("Syncing %s to %s...\n", strings.Join(srcs, ","), dst)
-		for _, src := range srcs {
-			srcStorage, err := storage.NewLocalStorage(src)
+	}
+	recipients := append([]string(nil), e.recipients...)
+	sort.Strings(recipients)
+	key += fmt.Sprintf("\x00encrypt=%t\x00encrypt-names=%t\x00recipients=%s", e.encrypt, e.encryptNames, strings.Join(recipients, "\x00"))
+	return storage.OpenIndex(filepath.Join(dir, "tri", "index"), key)
+}
+
+// retentionPolicy returns the bin retention policy from the cli flags
+func retentionPolicy(keepDays, keepLast int) storage.RetentionPolicy {
+	return storage.RetentionPolicy{
+		KeepLast:   keepLast,
+		KeepWithin: time.Duration(keepDays) * 24 * time.Hour,
+	}
+}
+
+func runSync(args []string) {
+	syncCommand := flag.NewFlagSet("sync", flag.ExitOnError)
+	syncCommand.BoolVar(&options.Verbose, "v", false, "Display INFO level log")
+	syncCommand.IntVar(&syncOptions.binKeepDays, "bin-keep-days", 0, "Purge the bin generations older than this number of days (0 keeps them)")
+	syncCommand.IntVar(&syncOptions.binKeepLast, "bin-keep-last", 0, "Only keep this number of bin generations (0 keeps them all)")
+	syncCommand.BoolVar(&syncOptions.checksum, "checksum", false, "Compare the content hashes of the files, not only their size and modification time")
+	syncCommand.BoolVar(&syncOptions.continueOnError, "continue-on-error", false, fmt.Sprintf("Sync the other files when some can't be read or copied, then exit with code %d", exitPartial))
+	syncCommand.BoolVar(&syncOptions.dedup, "dedup", false, "Store deduplicated snapshots in dst (a repository) instead of a mirror, implied when dst is a repository")
+	syncCommand.IntVar(&syncOptions.transfers, "j", storage.DefaultTransfers, "Number of files copied at the same time")
+	syncCommand.BoolVar(&syncOptions.noIndex, "no-index", false, "List the whole destination instead of using its local index")
+	syncOptions.encryption.addFlags(syncCommand)
+	syncCommand.Parse(args)
+	if options.Verbose {
+		log.SetLevel(log.InfoLevel)
+	}
+	if syncCommand.NArg() < 2 {
+		log.Fatal("sync should be followed by <src>... <dst>")
+	}
+	srcs := syncCommand.Args()[:syncCommand.NArg()-1]
+	dst := syncCommand.Arg(syncCommand.NArg() - 1)
+	if syncOptions.dedup {
+		checkRepositoryFlags(syncCommand)
+	}
+	// Reading the config of a repository needs the private key
+	dstStorage := openDestination(dst, syncOptions.encryption, true, syncOptions.dedup)
+	if repo := openRepository(dstStorage, syncOptions.dedup); repo != nil {
+		checkRepositoryFlags(syncCommand)
+		if len(srcs) > 1 {
+			log.Fatal("A repository (-dedup) stores the snapshots of a single source")
+		}
+		srcStorage := openSource(srcs[0])
+		snapshot, stats, err := repo.Backup(srcStorage, ".")
+		if err != nil {
+			log.Fatalf("Failed to backup source %s: %s\n", srcs[0], err)
+		}
+		log.Infof("Snapshot %s: %d files, %d new chunks (%d bytes)", snapshot.ID, stats.Files, stats.NewChunks, stats.NewBytes)
+		return
+	}
+
+	// dst mirrors a single source: syncing another one at the same place
+	// would move the files of the first to the bin. So with several sources,
+	// each one is synced to its own directory of dst
+	dstRoots := []string{"."}
+	if len(srcs) > 1 {
+		dstRoots = sourceNames(srcs)
+	}
+	var partial []string
+	for i, src := range srcs {
+		srcStorage := openSource(src)
+		if err := dstStorage.Mkdir(dstRoots[i]); err != nil {
+			log.Fatalf("Failed to create %s: %s\n", joinLocation(dst, dstRoots[i]), err)
+		}
+		opts := storage.SyncOptions{
+			BinRetention:    retentionPolicy(syncOptions.binKeepDays, syncOptions.binKeepLast),
+			Checksum:        syncOptions.checksum,
+			ContinueOnError: syncOptions.continueOnError,
+			Transfers:       syncOptions.transfers,
+		}
+		if !syncOptions.noIndex {
+			opts.Index = openIndex(joinLocation(dst, dstRoots[i]), syncOptions.encryption)
+		}
+		log.Infof("Syncing %s to %s...\n", src, joinLocation(dst, dstRoots[i]))
+		err := storage.SyncWithOptions(srcStorage, ".", dstStorage, dstRoots[i], opts)
+		if p, ok := err.(*storage.PartialSyncError); ok {
+			for _, f := range p.Files {
+				partial = append(partial, fmt.Sprintf("%s: %s", joinLocation(src, f.Path), f.Err))
+			}
+			continue
+		}
+		if err != nil {
+			log.Fatalf("Failed to sync source %s: %s\n", src, err)
+		}
+	}
+	if len(partial) > 0 {
+		fmt.Fprintf(os.Stderr, "%d files could not be synced:\n", len(partial))
+		for _, f := range partial {
+			fmt.Fprintf(os.Stderr, "  - %s\n", f)
+		}
+		os.Exit(exitPartial)
+	}
+}
+
+// openSource returns the storage at src, which can be read-only
+func openSource(src string) storage.ReadableStorage {
+	srcStorage, err := storage.OpenReadable(src)
+	if err != nil {
+		log.Fatalf("Failed to read source %s: %s\n", src, err)
+	}
+	return srcStorage
+}
+
+// sourceNames returns the directories of dst the sources are synced to when
+// there are several of them: the last element of their path
+func sourceNames(srcs []string) []string {
+	names := make([]string, len(srcs))
+	seen := make(map[string]string, len(srcs))
+	for i, src := range srcs {
+		name := filepath.Base(filepath.Clean(src))
+		if isURL(src) {
+			name = path.Base(strings.TrimSuffix(src[strings.Index(src, "://")+3:], "/"))
+		}
+		if name == "." || name == "/" || name == string(filepath.Separator) || name == ".." {
+			log.Fatalf("Source %s has no name to sync it to in the destination\n", src)
+		}
+		if other, ok := seen[name]; ok {
+			log.Fatalf("Sources %s and %s would both be synced to %s\n", other, src, name)
+		}
+		seen[name] = src
+		names[i] = name
+	}
+	return names
+}
+
+func runRestore(args []string) {
+	restoreCommand := flag.NewFlagSet("restore", flag.ExitOnError)
+	restoreCommand.BoolVar(&options.Verbose, "v", false, "Display INFO level log")
+	restoreCommand.BoolVar(&restoreOptions.overwrite, "overwrite", false, "Replace the files already in target")
+	restoreCommand.StringVar(&restoreOptions.snapshot, "snapshot", "", "Restore the state of this snapshot (see snapshots) instead of the latest one")
+	restoreOptions.encryption.addFlags(restoreCommand)
+	restoreCommand.Parse(args)
+	if options.Verbose {
+		log.SetLevel(log.InfoLevel)
+	}
+	if restoreCommand.NArg() < 2 || restoreCommand.NArg() > 3 {
+		log.Fatal("restore should be followed by <backup> <target> [<path|glob>]")
+	}
+	backup := openDestination(restoreCommand.Arg(0), restoreOptions.encryption, false, true)
+	target := restoreCommand.Arg(1)
+	if !isURL(target) {
+		if err := os.MkdirAll(target, 0755); err != nil {
+			log.Fatalf("Failed to create target %s: %s\n", target, err)
+		}
+	}
+	targetStorage, err := storage.Open(target)
+	if err != nil {
+		log.Fatalf("Failed to read target %s: %s\n", target, err)
+	}
+	opts := storage.RestoreOptions{
+		Pattern:   restoreCommand.Arg(2),
+		Overwrite: restoreOptions.overwrite,
+		Snapshot:  restoreOptions.snapshot,
+	}
+	log.Infof("Restoring %s to %s...\n", restoreCommand.Arg(0), target)
+	if repo := openRepository(backup, false); repo != nil {
+		_, err = repo.Restore(targetStorage, ".", opts)
+	} else {
+		_, err = storage.Restore(backup, ".", targetStorage, ".", opts)
+	}
+	if err != nil {
+		log.Fatalf("Failed to restore %s: %s\n", restoreCommand.Arg(0), err)
+	}
+}
+
+func runSnapshots(args []string) {
+	snapshotsCommand := flag.NewFlagSet("snapshots", flag.ExitOnError)
+	snapshotsCommand.BoolVar(&options.Verbose, "v", false, "Display INFO level log")
+	snapshotsOptions.encryption.addFlags(snapshotsCommand)
+	snapshotsCommand.Parse(args)
+	if options.Verbose {
+		log.SetLevel(log.InfoLevel)
+	}
+	if snapshotsCommand.NArg() != 1 {
+		log.Fatal("snapshots should be followed by <dst>")
+	}
+	dstStorage := openDestination(snapshotsCommand.Arg(0), snapshotsOptions.encryption, false, true)
+	ids, err := storage.Snapshots(dstStorage, ".")
+	if err != nil {
+		log.Fatalf("Failed to list snapshots: %s\n", err)
+	}
+	for _, id := range ids {
+		snapshot, err := storage.ReadSnapshot(dstStorage, ".", id)
+		if err != nil {
+			log.Fatalf("Failed to read snapshot %s: %s\n", id, err)
+		}
+		files, size := treeStats(snapshot.Tree)
+		fmt.Printf("%s\t%s\t%d files\t%d bytes\n", id, snapshot.Time.Local().Format("2006-01-02 15:04:05"), files, size)
+	}
+}
+
+// treeStats returns the number of files under n and their total size
+func treeStats(n storage.SyncNode) (files int, size int64) {
+	for _, c := range n.Children {
+		if c.IsDirectory {
+			childFiles, childSize := treeStats(c)
+			files += childFiles
+			size += childSize
+			continue
+		}
+		files++
+		size += int64(c.Size)
+	}
+	return files, size
+}
+
+func runBin(args []string) {
+	binCommand := flag.NewFlagSet("bin", flag.ExitOnError)
+	binCommand.BoolVar(&options.Verbose, "v", false, "Display INFO level log")
+	binCommand.BoolVar(&binOptions.encryptNames, "encrypt-names", false, "The names in dst are encrypted with the passphrase in $"+passphraseEnv)
+	binCommand.IntVar(&binOptions.keepDays, "keep-days", 0, "With purge, remove the generations older than this number of days")
+	binCommand.IntVar(&binOptions.keepLast, "keep-last", 0, "With purge, only keep this number of generations")
+	if len(args) == 0 {
+		log.Fatal("bin should be followed by list, restore or purge")
+	}
+	action := args[0]
+	binCommand.Parse(args[1:])
+	if options.Verbose {
+		log.SetLevel(log.InfoLevel)
+	}
+	if binCommand.NArg() < 1 {
+		log.Fatalf("bin %s should be followed by <dst>", action)
+	}
+	dstStorage := openDestination(binCommand.Arg(0), encryptionOptions{encryptNames: binOptions.encryptNames}, false, false)
+	bin := storage.NewBin(dstStorage, ".")
+
+	switch action {
+	case "list":
+		if binCommand.NArg() > 1 {
+			tree, err := bin.List(binCommand.Arg(1))
 			if err != nil {
-				log.Fatalf("Failed to read source %s: %s\n", src, err)
-				continue
+				log.Fatalf("Failed to list generation %s: %s\n", binCommand.Arg(1), err)
 			}
-			err = storage.Sync(srcStorage, ".", dstStorage, ".")
+			printTree(tree, "")
+			return
+		}
+		generations, err := bin.Generations()
+		if err != nil {
+			log.Fatalf("Failed to list bin: %s\n", err)
+		}
+		for _, g := range generations {
+			fmt.Printf("%s\t%s\n", g.Name, g.Time.Local().Format("2006-01-02 15:04:05"))
+		}
+	case "restore":
+		if binCommand.NArg() < 2 {
+			log.Fatal("bin restore should be followed by <dst> <generation> [<path>]")
+		}
+		path := "."
+		if binCommand.NArg() > 2 {
+			path = binCommand.Arg(2)
+		}
+		err := bin.Restore(binCommand.Arg(1), path)
+		if err != nil {
+			log.Fatalf("Failed to restore %s from %s: %s\n", path, binCommand.Arg(1), err)
+		}
+	case "purge":
+		if binCommand.NArg() > 1 {
+			err := bin.Purge(binCommand.Arg(1))
 			if err != nil {
-				log.Fatalf("Failed to sync source %s: %s\n", src, err)
+				log.Fatalf("Failed to purge %s: %s\n", binCommand.Arg(1), err)
 			}
+			return
+		}
+		policy := retentionPolicy(binOptions.keepDays, binOptions.keepLast)
+		if policy.IsZero() {
+			log.Fatal("bin purge needs a <generation> or -keep-days/-keep-last")
+		}
+		purged, err := bin.ApplyRetention(policy)
+		if err != nil {
+			log.Fatalf("Failed to purge bin: %s\n", err)
+		}
+		for _, g := range purged {
+			fmt.Printf("Purged %s\n", g)
 		}
-
 	default:
-		log.Fatalf("%s is not valid command.\n", os.Args[1])
+		log.Fatalf("%s is not a valid bin command.\n", action)
+	}
+}
+
+// printTree prints the files under n, one path per line
+func printTree(n storage.SyncNode, prefix string) {
+	for _, c := range n.Children {
+		if c.IsDirectory {
+			printTree(c, prefix+c.Name+"/")
+			continue
+		}
+		fmt.Printf("%s%s\n", prefix, c.Name)
 	}
 }
@@ -0,0 +1,423 @@
+package storage
+
+import (
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// BinDirectory is the directory, at the root of a destination, where Sync
+	// moves the files that no longer exist in the source
+	BinDirectory = ".tri-bin"
+	// binTimeFormat is the layout used to name each generation of the bin
+	binTimeFormat = "20060102-150405"
+)
+
+// now is overridden in tests to get predictable bin generations
+var now = time.Now
+
+// isReservedFile returns whether name is one of the files tri writes
+// unencrypted at the root of a destination
+func isReservedFile(name string) bool {
+	return name == KeyMetadataFile || name == IndexFile || name == MasterKeyFile
+}
+
+// withoutReserved returns n without the files tri keeps at the root of a
+// destination (the bin, the snapshots, the data keys, the index token, the key
+// metadata and the master key) in its direct children
+func withoutReserved(n SyncNode) SyncNode {
+	children := make([]SyncNode, 0, len(n.Children))
+	for _, c := range n.Children {
+		reservedDirectory := c.Name == BinDirectory || c.Name == SnapshotDirectory || c.Name == DataKeyDirectory
+		if (reservedDirectory && c.IsDirectory) || (isReservedFile(c.Name) && !c.IsDirectory) {
+			continue
+		}
+		children = append(children, c)
+	}
+	n.Children = children
+	return n
+}
+
+// moveExtraToBin moves the nodes of extra (see ExtraTree) under binPath,
+// keeping their path relative to dstPath. srcNode is used to tell apart
+// the directories that only have some extra children
+func moveExtraToBin(s Storage, extra, srcNode SyncNode, dstPath, binPath string) error {
+	srcChildren := make(map[string]SyncNode, len(srcNode.Children))
+	for _, c := range srcNode.Children {
+		srcChildren[c.Name] = c
+	}
+	binCreated := false
+	for _, c := range extra.Children {
+		childDst := dstPath + "/" + c.Name
+		childBin := binPath + "/" + c.Name
+		srcChild, ok := srcChildren[c.Name]
+		if ok && srcChild.IsDirectory && c.IsDirectory {
+			err := moveExtraToBin(s, c, srcChild, childDst, childBin)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if !binCreated {
+			err := s.Mkdir(binPath)
+			if err != nil {
+				return errors.Wrap(err, "failed to create directory "+binPath)
+			}
+			binCreated = true
+		}
+		log.Infof("Moving %s to bin", childDst)
+		err := moveTree(s, c, childDst, childBin)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveTree moves the node n from srcPath to dstPath. The parent of dstPath
+// should already exist. Directories are recreated at dstPath and removed
+// from srcPath once emptied
+func moveTree(s Storage, n SyncNode, srcPath, dstPath string) error {
+	if !n.IsDirectory {
+		err := s.Move(srcPath, dstPath)
+		if err != nil {
+			return errors.Wrap(err, "failed to move "+srcPath+" to "+dstPath)
+		}
+		return nil
+	}
+	err := s.Mkdir(dstPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to create directory "+dstPath)
+	}
+	for _, c := range n.Children {
+		err = moveTree(s, c, srcPath+"/"+c.Name, dstPath+"/"+c.Name)
+		if err != nil {
+			return err
+		}
+	}
+	err = s.Remove(srcPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to remove "+srcPath)
+	}
+	return nil
+}
+
+// RetentionPolicy defines which generations of the bin are kept. A generation
+// is kept as soon as one of the set rules keeps it; the zero value keeps
+// everything forever
+type RetentionPolicy struct {
+	KeepLast   int           // Keep the KeepLast most recent generations
+	KeepWithin time.Duration // Keep the generations younger than KeepWithin
+}
+
+// IsZero returns whether the policy keeps everything
+func (p RetentionPolicy) IsZero() bool {
+	return p.KeepLast <= 0 && p.KeepWithin <= 0
+}
+
+// BinGeneration is the set of files moved to the bin by a single Sync
+type BinGeneration struct {
+	Name string
+	Time time.Time
+}
+
+func (g BinGeneration) String() string {
+	return g.Name
+}
+
+// Bin gives access to the generations of files moved to the bin of a
+// destination by Sync
+type Bin struct {
+	s    Storage
+	root string
+}
+
+// NewBin returns the bin of the destination at root in s
+func NewBin(s Storage, root string) *Bin {
+	return &Bin{
+		s:    s,
+		root: root,
+	}
+}
+
+func (b *Bin) path() string {
+	return b.root + "/" + BinDirectory
+}
+
+// Generations returns the generations in the bin, oldest first
+func (b *Bin) Generations() ([]BinGeneration, error) {
+	listing, err := b.s.List(b.root)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list bin")
+	}
+	if _, ok := findObject(listing, BinDirectory); !ok {
+		return nil, nil // Nothing was ever moved to the bin
+	}
+	listing, err = b.s.List(b.path())
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list bin")
+	}
+	generations := make([]BinGeneration, 0, len(listing))
+	for _, l := range listing {
+		t, err := time.Parse(binTimeFormat, l.Name)
+		if err != nil || !l.IsDirectory {
+			continue // Not created by Sync
+		}
+		generations = append(generations, BinGeneration{Name: l.Name, Time: t})
+	}
+	sort.Slice(generations, func(i, j int) bool { return generations[i].Time.Before(generations[j].Time) })
+	return generations, nil
+}
+
+// generationPath returns the path of generation, ErrNotExist if it is not
+// one of Generations
+func (b *Bin) generationPath(generation string) (string, error) {
+	_, err := time.Parse(binTimeFormat, generation)
+	if err != nil || strings.Contains(generation, "/") || strings.Contains(generation, "..") {
+		return "", errors.Wrap(ErrNotExist, "no bin generation "+generation)
+	}
+	generations, err := b.Generations()
+	if err != nil {
+		return "", err
+	}
+	for _, g := range generations {
+		if g.Name == generation {
+			return b.path() + "/" + generation, nil
+		}
+	}
+	return "", errors.Wrap(ErrNotExist, "no bin generation "+generation)
+}
+
+// List returns the tree of the files in the given generation
+func (b *Bin) List(generation string) (SyncNode, error) {
+	genPath, err := b.generationPath(generation)
+	if err != nil {
+		return SyncNode{}, err
+	}
+	return GetTree(b.s, StoreObject{Name: generation, IsDirectory: true}, genPath)
+}
+
+// Restore moves back the relative path ("." for everything) from the given
+// generation to the destination. It never overwrites: it stops with
+// ErrAlreadyExist when a file is in the way
+func (b *Bin) Restore(generation, relative string) error {
+	binPath, err := b.generationPath(generation)
+	if err != nil {
+		return err
+	}
+	dstPath := b.root
+	relative = strings.Trim(path.Clean("/"+relative), "/")
+	if relative != "" {
+		binPath += "/" + relative
+		dstPath += "/" + relative
+	}
+	node, err := getNode(b.s, binPath)
+	if err != nil {
+		return err
+	}
+	if relative != "" {
+		err = b.s.Mkdir(path.Dir(dstPath))
+		if err != nil {
+			return errors.Wrap(err, "failed to create directory "+path.Dir(dstPath))
+		}
+	}
+	// The destination no longer is as left by the last sync
+	if _, err = writeIndexToken(b.s, b.root); err != nil {
+		return err
+	}
+	err = restoreTree(b.s, node, binPath, dstPath)
+	if err != nil {
+		return err
+	}
+	return removeEmptyParents(b.s, path.Dir(binPath), b.path())
+}
+
+// Purge removes a generation from the bin, and the snapshots older than it
+// since they may need some of its files
+func (b *Bin) Purge(generation string) error {
+	genPath, err := b.generationPath(generation)
+	if err != nil {
+		return err
+	}
+	node, err := GetTree(b.s, StoreObject{Name: generation, IsDirectory: true}, genPath)
+	if err != nil {
+		return err
+	}
+	if err = removeTree(b.s, node, genPath); err != nil {
+		return err
+	}
+	return pruneSnapshots(b.s, b.root, generation)
+}
+
+// ApplyRetention purges the generations that are not kept by the policy
+// and returns them
+func (b *Bin) ApplyRetention(p RetentionPolicy) ([]BinGeneration, error) {
+	if p.IsZero() {
+		return nil, nil
+	}
+	generations, err := b.Generations()
+	if err != nil {
+		return nil, err
+	}
+	limit := now().UTC().Add(-p.KeepWithin)
+	purged := make([]BinGeneration, 0, len(generations))
+	for i, g := range generations {
+		if p.KeepLast > 0 && len(generations)-i <= p.KeepLast {
+			continue
+		}
+		if p.KeepWithin > 0 && g.Time.After(limit) {
+			continue
+		}
+		log.Infof("Purging bin generation %s", g)
+		err = b.Purge(g.Name)
+		if err != nil {
+			return purged, errors.Wrap(err, "failed to purge "+g.Name)
+		}
+		purged = append(purged, g)
+	}
+	return purged, nil
+}
+
+// usedGenerations returns the names of the bin generations and the IDs of
+// the snapshots of the destination at root in s
+func usedGenerations(s Storage, root string) (map[string]bool, error) {
+	generations, err := NewBin(s, root).Generations()
+	if err != nil {
+		return nil, err
+	}
+	ids, err := Snapshots(s, root)
+	if err != nil {
+		return nil, err
+	}
+	used := make(map[string]bool, len(generations)+len(ids))
+	for _, g := range generations {
+		used[g.Name] = true
+	}
+	for _, id := range ids {
+		used[id] = true
+	}
+	return used, nil
+}
+
+// generationTime returns t, to the second, as the time of a new bin
+// generation and snapshot. Their names only have a second resolution: if it
+// is used, it returns the next second that is not, so a sync never writes in
+// the generation of another
+func generationTime(t time.Time, used func(name string) bool) time.Time {
+	t = t.UTC().Truncate(time.Second)
+	for used(t.Format(binTimeFormat)) {
+		t = t.Add(time.Second)
+	}
+	return t
+}
+
+// findObject returns the object called name in listing
+func findObject(listing []StoreObject, name string) (StoreObject, bool) {
+	for _, l := range listing {
+		if l.Name == name {
+			return l, true
+		}
+	}
+	return StoreObject{}, false
+}
+
+// getNode returns the tree at p, p being either a file or a directory
+func getNode(s Storage, p string) (SyncNode, error) {
+	listing, err := s.List(path.Dir(p))
+	if err != nil {
+		return SyncNode{}, errors.Wrap(err, "failed to list "+path.Dir(p))
+	}
+	obj, ok := findObject(listing, path.Base(p))
+	if !ok {
+		return SyncNode{}, errors.Wrap(ErrNotExist, p)
+	}
+	if !obj.IsDirectory {
+		return SyncNode{StoreObject: obj}, nil
+	}
+	return GetTree(s, obj, p)
+}
+
+// restoreTree moves the node n from binPath back to dstPath (whose parent
+// should exist) without overwriting any file
+func restoreTree(s Storage, n SyncNode, binPath, dstPath string) error {
+	if !n.IsDirectory {
+		listing, err := s.List(path.Dir(dstPath))
+		if err != nil {
+			return errors.Wrap(err, "failed to list "+path.Dir(dstPath))
+		}
+		if _, ok := findObject(listing, n.Name); ok {
+			return errors.Wrap(ErrAlreadyExist, dstPath)
+		}
+		log.Infof("Restoring %s", dstPath)
+		err = s.Move(binPath, dstPath)
+		if err != nil {
+			return errors.Wrap(err, "failed to move "+binPath+" to "+dstPath)
+		}
+		return nil
+	}
+	err := s.Mkdir(dstPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to create directory "+dstPath)
+	}
+	existing, err := s.List(dstPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to list "+dstPath)
+	}
+	for _, c := range n.Children {
+		if e, ok := findObject(existing, c.Name); ok && !(e.IsDirectory && c.IsDirectory) {
+			return errors.Wrap(ErrAlreadyExist, dstPath+"/"+c.Name)
+		}
+	}
+	for _, c := range n.Children {
+		err = restoreTree(s, c, binPath+"/"+c.Name, dstPath+"/"+c.Name)
+		if err != nil {
+			return err
+		}
+	}
+	err = s.Remove(binPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to remove "+binPath)
+	}
+	return nil
+}
+
+// removeTree removes the node n at p and everything below it
+func removeTree(s Storage, n SyncNode, p string) error {
+	for _, c := range n.Children {
+		err := removeTree(s, c, p+"/"+c.Name)
+		if err != nil {
+			return err
+		}
+	}
+	err := s.Remove(p)
+	if err != nil {
+		return errors.Wrap(err, "failed to remove "+p)
+	}
+	return nil
+}
+
+// removeEmptyParents removes p and its parents while they are empty,
+// stopping before stop
+func removeEmptyParents(s Storage, p, stop string) error {
+	p, stop = path.Clean(p), path.Clean(stop)
+	for p != stop && strings.HasPrefix(p, stop+"/") {
+		listing, err := s.List(p)
+		if err != nil {
+			return errors.Wrap(err, "failed to list "+p)
+		}
+		if len(listing) > 0 {
+			return nil
+		}
+		err = s.Remove(p)
+		if err != nil {
+			return errors.Wrap(err, "failed to remove "+p)
+		}
+		p = path.Dir(p)
+	}
+	return nil
+}
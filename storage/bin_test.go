@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// fillBin syncs an empty source to dst at each given time so everything
+// in dst ends up in a new bin generation
+func fillBin(t *testing.T, dst *LocalStorage, times ...time.Time) {
+	src, cleanup := newTempLocalStorage(t)
+	defer cleanup()
+	defer func() { now = time.Now }()
+	for i, date := range times {
+		writeFile(t, dst.Root, "folder_a/file_a", "a")
+		writeFile(t, dst.Root, "file_b", "b")
+		if i == 0 {
+			writeFile(t, dst.Root, "folder_a/folder_b/file_c", "c")
+		}
+		now = func() time.Time { return date }
+		if err := Sync(src, ".", dst, "."); err != nil {
+			t.Fatalf("Failed to sync: %s", err)
+		}
+	}
+}
+
+func TestBinGenerations(t *testing.T) {
+	assert := assert.New(t)
+	dst, cleanup := newTempLocalStorage(t)
+	defer cleanup()
+
+	bin := NewBin(dst, ".")
+	generations, err := bin.Generations()
+	assert.NoError(err)
+	assert.Len(generations, 0)
+
+	date1 := time.Date(2017, time.May, 17, 20, 10, 6, 0, time.UTC)
+	date2 := date1.Add(time.Hour)
+	fillBin(t, dst, date2, date1)
+	generations, err = bin.Generations()
+	assert.NoError(err)
+	assert.Equal([]BinGeneration{
+		BinGeneration{Name: "20170517-201006", Time: date1},
+		BinGeneration{Name: "20170517-211006", Time: date2},
+	}, generations)
+
+	tree, err := bin.List("20170517-211006")
+	assert.NoError(err)
+	assert.Len(tree.Children, 2)
+}
+
+func TestBinRestore(t *testing.T) {
+	assert := assert.New(t)
+	dst, cleanup := newTempLocalStorage(t)
+	defer cleanup()
+	fillBin(t, dst, time.Date(2017, time.May, 17, 20, 10, 6, 0, time.UTC))
+	bin := NewBin(dst, ".")
+
+	// Restore a single file
+	assert.NoError(bin.Restore("20170517-201006", "folder_a/folder_b/file_c"))
+	content, err := ioutil.ReadFile(filepath.Join(dst.Root, "folder_a", "folder_b", "file_c"))
+	assert.NoError(err)
+	assert.Equal("c", string(content))
+	_, err = os.Stat(filepath.Join(dst.Root, BinDirectory, "20170517-201006", "folder_a", "folder_b"))
+	assert.True(os.IsNotExist(err), "emptied directories should be removed from the bin")
+
+	// Don't overwrite
+	writeFile(t, dst.Root, "file_b", "new b")
+	err = bin.Restore("20170517-201006", ".")
+	assert.Equal(ErrAlreadyExist, errors.Cause(err))
+	assert.NoError(os.Remove(filepath.Join(dst.Root, "file_b")))
+
+	// Restore everything, the generation should be gone
+	assert.NoError(bin.Restore("20170517-201006", "."))
+	content, err = ioutil.ReadFile(filepath.Join(dst.Root, "folder_a", "file_a"))
+	assert.NoError(err)
+	assert.Equal("a", string(content))
+	generations, err := bin.Generations()
+	assert.NoError(err)
+	assert.Len(generations, 0)
+}
+
+func TestBinRetention(t *testing.T) {
+	assert := assert.New(t)
+	dst, cleanup := newTempLocalStorage(t)
+	defer cleanup()
+	date := time.Date(2017, time.May, 17, 20, 10, 6, 0, time.UTC)
+	fillBin(t, dst, date, date.AddDate(0, 0, 1), date.AddDate(0, 0, 2), date.AddDate(0, 0, 3))
+	bin := NewBin(dst, ".")
+
+	defer func() { now = time.Now }()
+	now = func() time.Time { return date.AddDate(0, 0, 3) }
+
+	purged, err := bin.ApplyRetention(RetentionPolicy{})
+	assert.NoError(err)
+	assert.Len(purged, 0)
+
+	// Union of the rules: last one and the ones within 36h
+	purged, err = bin.ApplyRetention(RetentionPolicy{KeepLast: 1, KeepWithin: 36 * time.Hour})
+	assert.NoError(err)
+	assert.Equal([]BinGeneration{
+		BinGeneration{Name: "20170517-201006", Time: date},
+		BinGeneration{Name: "20170518-201006", Time: date.AddDate(0, 0, 1)},
+	}, purged)
+
+	purged, err = bin.ApplyRetention(RetentionPolicy{KeepLast: 1})
+	assert.NoError(err)
+	assert.Len(purged, 1)
+	generations, err := bin.Generations()
+	assert.NoError(err)
+	assert.Equal([]BinGeneration{BinGeneration{Name: "20170520-201006", Time: date.AddDate(0, 0, 3)}}, generations)
+	_, err = os.Stat(filepath.Join(dst.Root, BinDirectory, "20170519-201006"))
+	assert.True(os.IsNotExist(err), "purged generation should be removed")
+}
+
+func TestBinInvalidGeneration(t *testing.T) {
+	assert := assert.New(t)
+	dst, cleanup := newTempLocalStorage(t)
+	defer cleanup()
+	fillBin(t, dst, time.Date(2017, time.May, 17, 20, 10, 6, 0, time.UTC))
+	bin := NewBin(dst, ".")
+
+	for _, generation := range []string{"..", ".", "a/../..", "", "20170517-201006/..", "20170518-201006"} {
+		_, err := bin.List(generation)
+		assert.Equal(ErrNotExist, errors.Cause(err), generation)
+		assert.Equal(ErrNotExist, errors.Cause(bin.Purge(generation)), generation)
+		assert.Equal(ErrNotExist, errors.Cause(bin.Restore(generation, ".")), generation)
+	}
+	assert.Equal("b", readFile(t, dst.Root, BinDirectory+"/20170517-201006/file_b"), "nothing should be removed")
+	generations, err := bin.Generations()
+	assert.NoError(err)
+	assert.Len(generations, 1)
+}
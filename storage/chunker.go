@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// ChunkerParams are the sizes of the content-defined chunks of a Repository
+type ChunkerParams struct {
+	MinSize int  `json:"min_size"`
+	AvgBits uint `json:"avg_bits"` // Chunks are about 2^AvgBits bytes after MinSize
+	MaxSize int  `json:"max_size"`
+}
+
+// DefaultChunkerParams are the parameters of new repositories
+var DefaultChunkerParams = ChunkerParams{MinSize: 512 << 10, AvgBits: 20, MaxSize: 8 << 20}
+
+// ErrInvalidChunkerParams is returned for chunker parameters that can't work
+var ErrInvalidChunkerParams = errors.New("invalid chunker parameters")
+
+const (
+	// maxChunkSize bounds MaxSize, chunks are read in memory
+	maxChunkSize = 64 << 20
+	// maxChunkAvgBits bounds AvgBits to an average up to maxChunkSize
+	maxChunkAvgBits = 26
+)
+
+// valid returns whether the parameters can work. They are read back from the
+// repository, so they are also bounded to keep the chunks in memory
+func (p ChunkerParams) valid() bool {
+	return p.MinSize > 0 && p.MaxSize >= p.MinSize && p.MaxSize <= maxChunkSize &&
+		p.AvgBits > 0 && p.AvgBits <= maxChunkAvgBits
+}
+
+// gearTable maps each byte to a random value for the gear rolling hash, it
+// is derived from a constant seed so chunk boundaries never change
+var gearTable [256]uint64
+
+func init() {
+	for i := range gearTable {
+		sum := sha256.Sum256([]byte("tri gear " + strconv.Itoa(i)))
+		gearTable[i] = binary.LittleEndian.Uint64(sum[:8])
+	}
+}
+
+// chunker splits a stream in content-defined chunks: a chunk ends where the
+// gear hash of the last 64 bytes has its AvgBits top bits unset, so an
+// insertion only changes the chunks around it
+type chunker struct {
+	r      *bufio.Reader
+	params ChunkerParams
+	buf    []byte
+}
+
+func newChunker(r io.Reader, params ChunkerParams) *chunker {
+	return &chunker{
+		r:      bufio.NewReader(r),
+		params: params,
+		buf:    make([]byte, 0, params.MaxSize),
+	}
+}
+
+// Next returns the next chunk or io.EOF once everything was read. The chunk
+// is only valid until the next call
+func (c *chunker) Next() ([]byte, error) {
+	c.buf = c.buf[:0]
+	shift := 64 - c.params.AvgBits
+	var hash uint64
+	for len(c.buf) < c.params.MaxSize {
+		b, err := c.r.ReadByte()
+		if err == io.EOF {
+			if len(c.buf) == 0 {
+				return nil, io.EOF
+			}
+			return c.buf, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		c.buf = append(c.buf, b)
+		hash = hash<<1 + gearTable[b]
+		if len(c.buf) >= c.params.MinSize && hash>>shift == 0 {
+			break
+		}
+	}
+	return c.buf, nil
+}
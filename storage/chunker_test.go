@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testChunkerParams = ChunkerParams{MinSize: 256, AvgBits: 10, MaxSize: 4096}
+
+// chunkAll returns the chunks of data
+func chunkAll(t *testing.T, data []byte, params ChunkerParams) [][]byte {
+	var chunks [][]byte
+	c := newChunker(bytes.NewReader(data), params)
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			return chunks
+		}
+		if err != nil {
+			t.Fatalf("Failed to chunk: %s", err)
+		}
+		chunks = append(chunks, append([]byte{}, chunk...))
+	}
+}
+
+func TestChunker(t *testing.T) {
+	assert := assert.New(t)
+	data := make([]byte, 256<<10)
+	rand.New(rand.NewSource(42)).Read(data)
+
+	chunks := chunkAll(t, data, testChunkerParams)
+	assert.True(len(chunks) > 32, "chunks should be about 1KiB, got %d chunks", len(chunks))
+	for i, c := range chunks {
+		assert.True(len(c) <= testChunkerParams.MaxSize)
+		if i < len(chunks)-1 {
+			assert.True(len(c) >= testChunkerParams.MinSize)
+		}
+	}
+	assert.Equal(data, bytes.Join(chunks, nil))
+	assert.Empty(chunkAll(t, nil, testChunkerParams))
+
+	// Inserting data only changes the chunks around it
+	shifted := append([]byte("inserted data"), data...)
+	before := make(map[string]bool)
+	for _, c := range chunks {
+		before[string(c)] = true
+	}
+	shiftedChunks := chunkAll(t, shifted, testChunkerParams)
+	changed := 0
+	for _, c := range shiftedChunks {
+		if !before[string(c)] {
+			changed++
+		}
+	}
+	assert.True(changed <= 2, "%d chunks changed", changed)
+
+	// Data without boundary is cut at MaxSize
+	chunks = chunkAll(t, make([]byte, 10000), testChunkerParams)
+	if assert.Len(chunks, 3) {
+		assert.Len(chunks[0], testChunkerParams.MaxSize)
+	}
+}
+
+func TestChunkerParams(t *testing.T) {
+	assert := assert.New(t)
+	assert.True(DefaultChunkerParams.valid())
+	assert.True(testChunkerParams.valid())
+	for _, p := range []ChunkerParams{
+		{},
+		{MinSize: 256, AvgBits: 10, MaxSize: 128},
+		{MinSize: 256, AvgBits: 0, MaxSize: 4096},
+		{MinSize: 256, AvgBits: 40, MaxSize: 4096},
+		{MinSize: 256, AvgBits: 10, MaxSize: 1 << 40},
+		{MinSize: 1 << 40, AvgBits: 10, MaxSize: 1 << 40},
+	} {
+		assert.False(p.valid(), "%+v", p)
+	}
+}
@@ -0,0 +1,404 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Viq111/tri/crypt"
+)
+
+const (
+	// DataKeyDirectory is the directory, at the root of a destination, holding
+	// the data keys of NewHybridEncryptedStorage wrapped for their recipients
+	DataKeyDirectory = ".tri-data-keys"
+	// MasterKeyFile is the file, at the root of a destination, describing how
+	// its master key is derived from the passphrase. It never holds the key
+	MasterKeyFile = ".tri-master-key.json"
+	// maxNameLength is the longest name most filesystems (ext4, NTFS...) allow
+	maxNameLength = 255
+)
+
+// Defines exported errors
+var (
+	ErrNoKey        = errors.New("encryption key is empty")
+	ErrNameTooLong  = errors.New("encrypted name is too long")
+	ErrNoMasterKey  = errors.New("no master key in the destination")
+	ErrNoPrivateKey = errors.New("private key is needed to decrypt")
+)
+
+// MasterKey returns the key derived from passphrase for the destination at
+// root in s, the backend of the EncryptedStorage. The KDF parameters and salt
+// are read from the MasterKeyFile, a new one is written if create is set and
+// there is none. It returns crypt.ErrCorruptedMessage if passphrase is wrong
+func MasterKey(s Storage, root string, passphrase []byte, create bool) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, ErrNoKey
+	}
+	listing, err := s.List(root)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list "+root)
+	}
+	if _, ok := findObject(listing, MasterKeyFile); ok {
+		r, err := s.Download(root + "/" + MasterKeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to open master key")
+		}
+		defer r.Close()
+		header, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read master key")
+		}
+		return crypt.ParseMasterKey(passphrase, header)
+	}
+	if !create {
+		return nil, ErrNoMasterKey
+	}
+	key, header, err := crypt.NewMasterKey(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	w, err := s.Upload(root+"/"+MasterKeyFile, now())
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open master key")
+	}
+	_, err = w.Write(header)
+	err2 := w.Close()
+	if err == nil {
+		err = err2
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to write master key")
+	}
+	return key, nil
+}
+
+// contentCipher encrypts and decrypts the content of the files of an EncryptedStorage
+type contentCipher interface {
+	encrypter(dst io.WriteCloser) (io.WriteCloser, error)
+	decrypter(src io.ReadCloser) (io.ReadCloser, error)
+	plaintextSize(size int64) int64
+}
+
+// symetricCipher encrypts each file with the same key
+type symetricCipher struct {
+	key []byte
+}
+
+func (c symetricCipher) encrypter(dst io.WriteCloser) (io.WriteCloser, error) {
+	return crypt.NewStreamEncrypter(c.key, dst)
+}
+
+func (c symetricCipher) decrypter(src io.ReadCloser) (io.ReadCloser, error) {
+	return crypt.NewStreamDecrypter(c.key, src)
+}
+
+func (c symetricCipher) plaintextSize(size int64) int64 {
+	return crypt.StreamPlaintextSize(size)
+}
+
+// hybridCipher encrypts the files with a random data key, wrapped for each
+// recipient in a key file of the DataKeyDirectory of the backend
+type hybridCipher struct {
+	backend    Storage
+	recipients []crypt.PublicKey
+	priv       *crypt.PrivateKey
+
+	mu      sync.Mutex
+	keyID   []byte            // keyID is the key file of dataKey, written on first use
+	dataKey []byte            // dataKey encrypts the files uploaded
+	keys    map[string][]byte // keys are the data keys of the files downloaded, by key file
+}
+
+// currentKey returns the data key files are encrypted with and the ID of its
+// key file, a new one is written on first use
+func (c *hybridCipher) currentKey() ([]byte, []byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.keyID != nil {
+		return c.keyID, c.dataKey, nil
+	}
+	dataKey, keyFile, err := crypt.NewHybridKey(c.recipients)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyID := make([]byte, crypt.HybridKeyIDSize)
+	if _, err = rand.Read(keyID); err != nil {
+		return nil, nil, err
+	}
+	if err = c.backend.Mkdir(DataKeyDirectory); err != nil {
+		return nil, nil, errors.Wrap(err, "failed to create "+DataKeyDirectory)
+	}
+	keyPath := DataKeyDirectory + "/" + hex.EncodeToString(keyID)
+	w, err := c.backend.Upload(keyPath, now())
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to open "+keyPath)
+	}
+	_, err = w.Write(keyFile)
+	err2 := w.Close()
+	if err == nil {
+		err = err2
+	}
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to write "+keyPath)
+	}
+	c.keyID, c.dataKey = keyID, dataKey
+	return keyID, dataKey, nil
+}
+
+// unwrap returns the data key of the key file keyID, unwrapped with priv
+func (c *hybridCipher) unwrap(keyID []byte) ([]byte, error) {
+	if c.priv == nil {
+		return nil, ErrNoPrivateKey
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	name := hex.EncodeToString(keyID)
+	if dataKey, ok := c.keys[name]; ok {
+		return dataKey, nil
+	}
+	r, err := c.backend.Download(DataKeyDirectory + "/" + name)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open key file "+name)
+	}
+	defer r.Close()
+	keyFile, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read key file "+name)
+	}
+	dataKey, err := crypt.UnwrapHybridKey(*c.priv, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if c.keys == nil {
+		c.keys = make(map[string][]byte)
+	}
+	c.keys[name] = dataKey
+	return dataKey, nil
+}
+
+func (c *hybridCipher) encrypter(dst io.WriteCloser) (io.WriteCloser, error) {
+	keyID, dataKey, err := c.currentKey()
+	if err != nil {
+		return nil, err
+	}
+	return crypt.NewHybridEncrypter(keyID, dataKey, dst)
+}
+
+func (c *hybridCipher) decrypter(src io.ReadCloser) (io.ReadCloser, error) {
+	if c.priv == nil {
+		return nil, ErrNoPrivateKey
+	}
+	return crypt.NewHybridDecrypter(src, c.unwrap)
+}
+
+func (c *hybridCipher) plaintextSize(size int64) int64 {
+	return crypt.StreamPlaintextSize(size - crypt.HybridHeaderSize)
+}
+
+// EncryptedStorage implements Storage on top of another Storage (the backend).
+// The content of the files is encrypted on Upload and decrypted on Download.
+// Names and tree layout are left as is unless EncryptNames is called
+type EncryptedStorage struct {
+	backend Storage
+	content contentCipher
+	names   *crypt.NameCipher
+}
+
+// NewEncryptedStorage returns a storage encrypting the files written
+// to backend with key, a random key or one returned by MasterKey
+func NewEncryptedStorage(backend Storage, key []byte) (*EncryptedStorage, error) {
+	if len(key) == 0 {
+		return nil, ErrNoKey
+	}
+	return &EncryptedStorage{
+		backend: backend,
+		content: symetricCipher{key: key},
+	}, nil
+}
+
+// NewHybridEncryptedStorage returns a storage encrypting the files written to
+// backend with a new random data key, wrapped for each of the recipients in a
+// key file of the DataKeyDirectory. Each file still has its own stream key.
+// priv, the private key of any recipient, is only needed to Download and can
+// be nil so backups can be written without any private key. Listed sizes
+// don't depend on the recipients, so changing them doesn't re-copy the files
+func NewHybridEncryptedStorage(backend Storage, recipients []crypt.PublicKey, priv *crypt.PrivateKey) (*EncryptedStorage, error) {
+	if len(recipients) == 0 {
+		return nil, ErrNoKey
+	}
+	return &EncryptedStorage{
+		backend: backend,
+		content: &hybridCipher{backend: backend, recipients: recipients, priv: priv},
+	}, nil
+}
+
+// EncryptNames makes the storage encrypt each name of the paths given to
+// the backend with key (see NewEncryptedStorage), names are decrypted back
+// on List
+func (e *EncryptedStorage) EncryptNames(key []byte) error {
+	if len(key) == 0 {
+		return ErrNoKey
+	}
+	names, err := crypt.NewNameCipher(key)
+	if err != nil {
+		return err
+	}
+	e.names = names
+	return nil
+}
+
+// rawStorage returns the storage, and the root in it, where tri keeps its
+// unencrypted files (see isReservedFile) for the destination at root in s
+func rawStorage(s Storage, root string) (Storage, string, error) {
+	e, ok := s.(*EncryptedStorage)
+	if !ok {
+		return s, root, nil
+	}
+	backendRoot, err := e.backendPath(root)
+	return e.backend, backendRoot, err
+}
+
+// backendPath returns the path as seen by the backend. It returns
+// ErrNameTooLong if an encrypted name would not fit in a filesystem
+func (e *EncryptedStorage) backendPath(path string) (string, error) {
+	if e.names == nil {
+		return path, nil
+	}
+	parts := strings.Split(path, "/")
+	for i, p := range parts {
+		if p == "" || p == "." || p == ".." {
+			continue
+		}
+		parts[i] = e.names.Encrypt(p)
+		if len(parts[i]) > maxNameLength {
+			return "", errors.Wrapf(ErrNameTooLong, "%s is %d bytes once encrypted, the limit is %d",
+				path, len(parts[i]), maxNameLength)
+		}
+	}
+	return strings.Join(parts, "/"), nil
+}
+
+// Download returns an object that can be read, decrypted as it is read
+func (e *EncryptedStorage) Download(path string) (io.ReadCloser, error) {
+	backendPath, err := e.backendPath(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := e.backend.Download(backendPath)
+	if err != nil {
+		return nil, err
+	}
+	d, err := e.content.decrypter(r)
+	if err != nil {
+		r.Close()
+		return nil, errors.Wrap(err, "failed to decrypt "+path)
+	}
+	return d, nil
+}
+
+// List returns a list of node in the path, names and sizes are the
+// decrypted ones. Names that can't be decrypted are skipped, as well as
+// the files tri writes unencrypted in the backend (see KeyMetadataFile)
+// and the DataKeyDirectory
+func (e *EncryptedStorage) List(path string) ([]StoreObject, error) {
+	return e.list(path, e.backend.List)
+}
+
+// listNames is List without the modification times when the backend can
+// skip them, see nameLister
+func (e *EncryptedStorage) listNames(path string) ([]StoreObject, error) {
+	return e.list(path, func(p string) ([]StoreObject, error) { return listNames(e.backend, p) })
+}
+
+// list returns the plain listing of path, listing the backend with list
+func (e *EncryptedStorage) list(path string, list func(string) ([]StoreObject, error)) ([]StoreObject, error) {
+	backendPath, err := e.backendPath(path)
+	if err != nil {
+		return nil, err
+	}
+	listing, err := list(backendPath)
+	if err != nil {
+		return nil, err
+	}
+	isRoot := path == "." || path == ""
+	nodes := make([]StoreObject, 0, len(listing))
+	for _, n := range listing {
+		if isRoot && n.IsDirectory && n.Name == DataKeyDirectory {
+			continue
+		}
+		if e.names != nil {
+			if strings.HasPrefix(n.Name, ".") { // Never an encrypted name
+				continue
+			}
+			name, err := e.names.Decrypt(n.Name)
+			if err != nil {
+				log.Warnf("Skipping %s/%s: %s", path, n.Name, err)
+				continue
+			}
+			n.Name = name
+		}
+		if !n.IsDirectory {
+			n.Size = int(e.content.plaintextSize(int64(n.Size)))
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
+
+// Mkdir creates a directory and potentially parents
+func (e *EncryptedStorage) Mkdir(path string) error {
+	backendPath, err := e.backendPath(path)
+	if err != nil {
+		return err
+	}
+	return e.backend.Mkdir(backendPath)
+}
+
+// Move moves a file to a new location
+func (e *EncryptedStorage) Move(src, dst string) error {
+	srcPath, err := e.backendPath(src)
+	if err != nil {
+		return err
+	}
+	dstPath, err := e.backendPath(dst)
+	if err != nil {
+		return err
+	}
+	return e.backend.Move(srcPath, dstPath)
+}
+
+// Remove a path (file or empty directory)
+func (e *EncryptedStorage) Remove(path string) error {
+	backendPath, err := e.backendPath(path)
+	if err != nil {
+		return err
+	}
+	return e.backend.Remove(backendPath)
+}
+
+// Upload returns an object that can be written to. The content is
+// encrypted as it is written
+func (e *EncryptedStorage) Upload(path string, modTime time.Time) (io.WriteCloser, error) {
+	backendPath, err := e.backendPath(path)
+	if err != nil {
+		return nil, err
+	}
+	w, err := e.backend.Upload(backendPath, modTime)
+	if err != nil {
+		return nil, err
+	}
+	encrypter, err := e.content.encrypter(w)
+	if err != nil {
+		w.Close()
+		return nil, errors.Wrap(err, "failed to encrypt "+path)
+	}
+	return encrypter, nil
+}
@@ -0,0 +1,264 @@
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Viq111/tri/crypt"
+)
+
+func TestEncryptedStorage(t *testing.T) {
+	assert := assert.New(t)
+
+	localStorage, cleanupTestPath, err := getLocalStorageAndCleanup()
+	if !assert.NoError(err, "failed to get storage") {
+		t.FailNow()
+	}
+	encryptedStorage, err := NewEncryptedStorage(localStorage, []byte("super secret 🍣"))
+	if !assert.NoError(err, "failed to get encrypted storage") {
+		t.FailNow()
+	}
+
+	testStorage := NewStorageTester(encryptedStorage, cleanupTestPath)
+	t.Run("EncryptedStorage", RunStorageTests(testStorage))
+}
+
+func TestEncryptedStorageCiphertext(t *testing.T) {
+	assert := assert.New(t)
+	backend, cleanup := newTempLocalStorage(t)
+	defer cleanup()
+	_, err := NewEncryptedStorage(backend, nil)
+	assert.Equal(ErrNoKey, err)
+	s, err := NewEncryptedStorage(backend, []byte("super secret 🍣"))
+	if !assert.NoError(err) {
+		t.FailNow()
+	}
+
+	plain := []byte("Hello World! 🍣")
+	f, err := s.Upload("file", time.Now())
+	assert.NoError(err)
+	_, err = f.Write(plain)
+	assert.NoError(err)
+	assert.NoError(f.Close())
+
+	// The backend only sees the encrypted content
+	raw, err := ioutil.ReadFile(filepath.Join(backend.Root, "file"))
+	assert.NoError(err)
+	assert.False(bytes.Contains(raw, plain), "content should be encrypted")
+
+	// But the listing has the plain size so it can be compared to a source
+	listing, err := s.List(".")
+	assert.NoError(err)
+	if assert.Len(listing, 1) {
+		assert.Equal(len(plain), listing[0].Size)
+	}
+
+	// Another key can't read it
+	other, err := NewEncryptedStorage(backend, []byte("not the key"))
+	assert.NoError(err)
+	r, err := other.Download("file")
+	if assert.NoError(err) {
+		_, err = ioutil.ReadAll(r)
+		assert.Error(err)
+		assert.NoError(r.Close())
+	}
+}
+
+func TestEncryptedStorageNames(t *testing.T) {
+	assert := assert.New(t)
+	src, cleanupSrc := newTempLocalStorage(t)
+	defer cleanupSrc()
+	backend, cleanupBackend := newTempLocalStorage(t)
+	defer cleanupBackend()
+	key := []byte("super secret 🍣")
+	dst, err := NewEncryptedStorage(backend, key)
+	assert.NoError(err)
+	assert.Equal(ErrNoKey, dst.EncryptNames(nil))
+	assert.NoError(dst.EncryptNames(key))
+
+	writeFile(t, src.Root, "folder_secret/file_secret", "content")
+	if !assert.NoError(Sync(src, ".", dst, ".")) {
+		t.FailNow()
+	}
+
+	// The backend doesn't know any name, not even the ones of the snapshots.
+	// Only the index token is kept in clear
+	tree, err := GetTree(backend, StoreObject{IsDirectory: true}, ".")
+	assert.NoError(err)
+	if assert.Len(tree.Children, 3) {
+		for _, c := range tree.Children {
+			if c.Name == IndexFile {
+				continue
+			}
+			assert.NotContains(c.Name, "secret")
+			assert.NotContains(c.Name, "snapshots")
+			if c.IsDirectory && assert.Len(c.Children, 1) {
+				assert.NotContains(c.Children[0].Name, "secret")
+			}
+		}
+	}
+
+	// But the encrypted storage gives back the plain view
+	tree, err = GetTree(dst, StoreObject{IsDirectory: true}, ".")
+	assert.NoError(err)
+	tree = withoutReserved(tree)
+	if assert.Len(tree.Children, 1) && assert.Len(tree.Children[0].Children, 1) {
+		assert.Equal("folder_secret", tree.Children[0].Name)
+		assert.Equal("file_secret", tree.Children[0].Children[0].Name)
+		assert.Equal(len("content"), tree.Children[0].Children[0].Size)
+	}
+	r, err := dst.Download("folder_secret/file_secret")
+	if assert.NoError(err) {
+		content, err := ioutil.ReadAll(r)
+		assert.NoError(err)
+		assert.Equal("content", string(content))
+		assert.NoError(r.Close())
+	}
+
+	// Unknown names are skipped, only the folder and the snapshots are listed
+	writeFile(t, backend.Root, "not_encrypted", "")
+	listing, err := dst.List(".")
+	assert.NoError(err)
+	assert.Len(listing, 2)
+
+	// Names too long once encrypted are reported with their path
+	long := strings.Repeat("a", 150)
+	writeFile(t, src.Root, "folder_secret/"+long, "content")
+	err = Sync(src, ".", dst, ".")
+	if assert.Error(err) {
+		assert.Equal(ErrNameTooLong, errors.Cause(err))
+		assert.Contains(err.Error(), "folder_secret/"+long)
+	}
+	_, err = dst.Upload(long, time.Now())
+	assert.Equal(ErrNameTooLong, errors.Cause(err))
+	assert.NoError(dst.Mkdir(strings.Repeat("a", 140)), "shorter names should fit")
+}
+
+func TestMasterKey(t *testing.T) {
+	assert := assert.New(t)
+	backend, cleanup := newTempLocalStorage(t)
+	defer cleanup()
+	passphrase := []byte("super secret 🍣")
+
+	_, err := MasterKey(backend, ".", nil, true)
+	assert.Equal(ErrNoKey, err)
+	_, err = MasterKey(backend, ".", passphrase, false)
+	assert.Equal(ErrNoMasterKey, err)
+	key, err := MasterKey(backend, ".", passphrase, true)
+	if !assert.NoError(err) {
+		t.FailNow()
+	}
+	assert.Len(key, crypt.MasterKeySize)
+
+	// The salt is kept in the destination, the key never is
+	raw, err := ioutil.ReadFile(filepath.Join(backend.Root, MasterKeyFile))
+	assert.NoError(err)
+	assert.False(bytes.Contains(raw, key))
+	again, err := MasterKey(backend, ".", passphrase, false)
+	assert.NoError(err)
+	assert.Equal(key, again)
+	_, err = MasterKey(backend, ".", []byte("not the passphrase"), true)
+	assert.Equal(crypt.ErrCorruptedMessage, err)
+
+	// Another destination gets another key
+	other, cleanupOther := newTempLocalStorage(t)
+	defer cleanupOther()
+	otherKey, err := MasterKey(other, ".", passphrase, true)
+	assert.NoError(err)
+	assert.NotEqual(key, otherKey)
+}
+
+func TestHybridEncryptedStorage(t *testing.T) {
+	if testing.Short() { // Key generation is slow, skip is we want fast
+		t.Skip()
+	}
+	assert := assert.New(t)
+	key, err := crypt.GenerateNewKey("testing", 1024)
+	if !assert.NoError(err) {
+		t.FailNow()
+	}
+	backend, cleanup := newTempLocalStorage(t)
+	defer cleanup()
+
+	// Backups only need the public key
+	writer, err := NewHybridEncryptedStorage(backend, []crypt.PublicKey{key.PubKey}, nil)
+	if !assert.NoError(err) {
+		t.FailNow()
+	}
+	plain := []byte("Hello World! 🍣")
+	f, err := writer.Upload("file", time.Now())
+	assert.NoError(err)
+	_, err = f.Write(plain)
+	assert.NoError(err)
+	assert.NoError(f.Close())
+	_, err = writer.Download("file")
+	assert.Equal(ErrNoPrivateKey, errors.Cause(err))
+	listing, err := writer.List(".")
+	assert.NoError(err)
+	if assert.Len(listing, 1) {
+		assert.Equal(len(plain), listing[0].Size)
+	}
+
+	// Restoring needs the private key
+	reader, err := NewHybridEncryptedStorage(backend, []crypt.PublicKey{key.PubKey}, &key)
+	assert.NoError(err)
+	r, err := reader.Download("file")
+	if assert.NoError(err) {
+		content, err := ioutil.ReadAll(r)
+		assert.NoError(err)
+		assert.Equal(plain, content)
+		assert.NoError(r.Close())
+	}
+
+	localStorage, cleanupTestPath, err := getLocalStorageAndCleanup()
+	if !assert.NoError(err, "failed to get storage") {
+		t.FailNow()
+	}
+	reader, err = NewHybridEncryptedStorage(localStorage, []crypt.PublicKey{key.PubKey}, &key)
+	assert.NoError(err)
+	t.Run("HybridEncryptedStorage", RunStorageTests(NewStorageTester(reader, cleanupTestPath)))
+}
+
+func TestHybridEncryptedStorageRecipients(t *testing.T) {
+	assert := assert.New(t)
+	keys := make([]crypt.PrivateKey, 2)
+	for i := range keys {
+		var err error
+		keys[i], err = crypt.GenerateX25519Key("testing")
+		if !assert.NoError(err) {
+			t.FailNow()
+		}
+	}
+	src, cleanupSrc := newTempLocalStorage(t)
+	defer cleanupSrc()
+	backend, cleanupBackend := newTempLocalStorage(t)
+	defer cleanupBackend()
+	writeFile(t, src.Root, "folder/file_a", "Hello World! 🍣")
+
+	first, err := NewHybridEncryptedStorage(backend, []crypt.PublicKey{keys[0].PubKey}, nil)
+	assert.NoError(err)
+	assert.NoError(Sync(src, ".", first, "."))
+	before := readFile(t, backend.Root, "folder/file_a")
+
+	// Adding a recipient, or rotating a key, doesn't change the sizes
+	both, err := NewHybridEncryptedStorage(backend, []crypt.PublicKey{keys[0].PubKey, keys[1].PubKey}, nil)
+	assert.NoError(err)
+	assert.NoError(Sync(src, ".", both, "."))
+	assert.Equal(before, readFile(t, backend.Root, "folder/file_a"), "nothing should be copied")
+	_, err = RotateKey(both, keys[0], keys[1].PubKey)
+	assert.NoError(err)
+	second, err := NewHybridEncryptedStorage(backend, []crypt.PublicKey{keys[1].PubKey}, &keys[1])
+	assert.NoError(err)
+	assert.NoError(Sync(src, ".", second, "."))
+	assert.Equal(before, readFile(t, backend.Root, "folder/file_a"), "nothing should be copied")
+	_, err = os.Stat(filepath.Join(backend.Root, BinDirectory))
+	assert.True(os.IsNotExist(err), "nothing should be moved to the bin")
+}
@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// IndexFile is the file, at the root of a destination, holding a random token
+// replaced by each sync. An Index is only used while it has the same token,
+// so a sync from another machine is noticed. It is never encrypted
+const IndexFile = ".tri-index"
+
+// Index is a local cache of the tree of a destination as left by the last
+// sync, with the hashes of its files. It saves listing the whole destination
+// at each sync. Changes to the destination made without tri are not seen
+type Index struct {
+	path string
+}
+
+// indexContent is what an Index saves locally
+type indexContent struct {
+	Token string   `json:"token"`
+	Tree  SyncNode `json:"tree"`
+	// Generation is the bin generation and snapshot ID of the last sync
+	Generation string `json:"generation,omitempty"`
+}
+
+// OpenIndex returns the index, in the local directory dir, of the
+// destination identified by key. The key has to change with anything changing
+// the tree of the destination, for instance its location, root and encryption
+func OpenIndex(dir, key string) *Index {
+	sum := sha256.Sum256([]byte(key))
+	return &Index{path: filepath.Join(dir, hex.EncodeToString(sum[:])+".json")}
+}
+
+// load returns the cached content of the destination at root in s and
+// whether the index is still up to date. Even when it is not, the hashes of
+// the files of its tree that didn't change since are still right
+func (i *Index) load(s Storage, root string) (indexContent, bool) {
+	content, err := ioutil.ReadFile(i.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Infof("Failed to read index %s: %s", i.path, err)
+		}
+		return indexContent{}, false
+	}
+	var index indexContent
+	if err = json.Unmarshal(content, &index); err != nil || index.Token == "" {
+		log.Infof("Ignoring invalid index %s", i.path)
+		return indexContent{}, false
+	}
+	raw, rawRoot, err := rawStorage(s, root)
+	if err != nil {
+		log.Infof("Ignoring index: %s", err)
+		return index, false
+	}
+	r, err := raw.Download(rawRoot + "/" + IndexFile)
+	if err != nil {
+		log.Infof("Failed to open %s, ignoring index: %s", IndexFile, err)
+		return index, false
+	}
+	defer r.Close()
+	token, err := ioutil.ReadAll(r)
+	if err != nil || string(token) != index.Token {
+		log.Info("Destination changed since the last sync, ignoring index")
+		return index, false
+	}
+	return index, true
+}
+
+// invalidate removes the index, it is called before changing the destination
+// so an interrupted sync doesn't leave it out of date
+func (i *Index) invalidate() error {
+	err := os.Remove(i.path)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to remove index "+i.path)
+	}
+	return nil
+}
+
+// save saves tree, the state of the destination with the given token after
+// the sync of the given generation
+func (i *Index) save(token string, tree SyncNode, generation string) error {
+	content, err := json.Marshal(indexContent{Token: token, Tree: tree, Generation: generation})
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(i.path), 0700); err != nil {
+		return errors.Wrap(err, "failed to create index directory")
+	}
+	tmp := i.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, content, 0600); err != nil {
+		return errors.Wrap(err, "failed to write index "+tmp)
+	}
+	return errors.Wrap(os.Rename(tmp, i.path), "failed to write index "+i.path)
+}
+
+// writeIndexToken replaces the token of the destination at root in s, so
+// that the indexes of all the machines are out of date, and returns it
+func writeIndexToken(s Storage, root string) (string, error) {
+	raw, rawRoot, err := rawStorage(s, root)
+	if err != nil {
+		return "", err
+	}
+	random := make([]byte, 16)
+	if _, err = rand.Read(random); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(random)
+	w, err := raw.Upload(rawRoot+"/"+IndexFile, time.Now())
+	if err != nil {
+		return "", errors.Wrap(err, "failed to open "+IndexFile)
+	}
+	_, err = w.Write([]byte(token))
+	err2 := w.Close()
+	if err == nil {
+		err = err2
+	}
+	return token, errors.Wrap(err, "failed to write "+IndexFile)
+}
@@ -0,0 +1,169 @@
+package storage
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Viq111/tri/crypt"
+)
+
+// countingStorage counts the listings and downloads of a Storage
+type countingStorage struct {
+	Storage
+	mu        sync.Mutex
+	lists     int
+	downloads int
+}
+
+func (s *countingStorage) Download(p string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	s.downloads++
+	s.mu.Unlock()
+	return s.Storage.Download(p)
+}
+
+func (s *countingStorage) List(p string) ([]StoreObject, error) {
+	s.mu.Lock()
+	s.lists++
+	s.mu.Unlock()
+	return s.Storage.List(p)
+}
+
+func TestSyncIndex(t *testing.T) {
+	assert := assert.New(t)
+	src, cleanupSrc := newTempLocalStorage(t)
+	defer cleanupSrc()
+	backend, cleanupDst := newTempLocalStorage(t)
+	defer cleanupDst()
+	cacheDir, err := ioutil.TempDir("", "tri-index")
+	if !assert.NoError(err) {
+		t.FailNow()
+	}
+	defer os.RemoveAll(cacheDir)
+	defer func() { now = time.Now }()
+	syncAt := func(minute int) {
+		now = func() time.Time { return time.Date(2017, time.May, 17, 20, minute, 0, 0, time.UTC) }
+	}
+	dst := &countingStorage{Storage: backend}
+	opts := SyncOptions{Index: OpenIndex(cacheDir, backend.Root)}
+
+	writeFile(t, src.Root, "file_a", "a")
+	writeFile(t, src.Root, "folder/file_b", "b")
+	syncAt(1)
+	assert.NoError(SyncWithOptions(src, ".", dst, ".", opts))
+	assert.NotZero(dst.lists, "the first sync lists the destination")
+
+	// Nothing changed: the destination isn't listed
+	dst.lists = 0
+	syncAt(2)
+	assert.NoError(SyncWithOptions(src, ".", dst, ".", opts))
+	assert.Zero(dst.lists)
+
+	// The index is updated by each sync
+	writeFile(t, src.Root, "folder/file_c", "c")
+	assert.NoError(os.Remove(filepath.Join(src.Root, "file_a")))
+	syncAt(3)
+	assert.NoError(SyncWithOptions(src, ".", dst, ".", opts))
+	assert.Zero(dst.lists)
+	assert.Equal("c", readFile(t, backend.Root, "folder/file_c"))
+	assert.Equal("a", readFile(t, backend.Root, BinDirectory+"/20170517-200300/file_a"))
+	syncAt(4)
+	assert.NoError(SyncWithOptions(src, ".", dst, ".", opts))
+	assert.Zero(dst.lists)
+	_, err = os.Stat(filepath.Join(backend.Root, BinDirectory, "20170517-200400"))
+	assert.True(os.IsNotExist(err), "nothing should be moved to the bin")
+
+	// A sync without the index makes it out of date
+	writeFile(t, src.Root, "file_d", "d")
+	syncAt(5)
+	assert.NoError(Sync(src, ".", backend, "."))
+	assert.NoError(os.Remove(filepath.Join(src.Root, "file_d")))
+	syncAt(6)
+	assert.NoError(SyncWithOptions(src, ".", dst, ".", opts))
+	assert.NotZero(dst.lists)
+	assert.Equal("d", readFile(t, backend.Root, BinDirectory+"/20170517-200600/file_d"))
+
+	// So does a restore from the bin
+	assert.NoError(NewBin(backend, ".").Restore("20170517-200600", "file_d"))
+	dst.lists = 0
+	syncAt(7)
+	assert.NoError(SyncWithOptions(src, ".", dst, ".", opts))
+	assert.NotZero(dst.lists)
+	assert.Equal("d", readFile(t, backend.Root, BinDirectory+"/20170517-200700/file_d"))
+
+	// An invalid index is ignored
+	assert.NoError(ioutil.WriteFile(opts.Index.path, []byte("{"), 0600))
+	dst.lists = 0
+	syncAt(8)
+	assert.NoError(SyncWithOptions(src, ".", dst, ".", opts))
+	assert.NotZero(dst.lists)
+
+	// The snapshots are the same as without the index
+	snapshot, err := ReadSnapshot(backend, ".", "20170517-200700")
+	if assert.NoError(err) {
+		tree := withoutReserved(snapshot.Tree)
+		if assert.Len(tree.Children, 1) && assert.Len(tree.Children[0].Children, 2) {
+			assert.Equal("folder", tree.Children[0].Name)
+			for _, c := range tree.Children[0].Children {
+				assert.NotEmpty(c.Hash)
+			}
+		}
+	}
+}
+
+func TestSyncIndexPublicKeyOnly(t *testing.T) {
+	if testing.Short() { // Key generation is slow, skip is we want fast
+		t.Skip()
+	}
+	assert := assert.New(t)
+	key, err := crypt.GenerateNewKey("testing", 1024)
+	if !assert.NoError(err) {
+		t.FailNow()
+	}
+	src, cleanupSrc := newTempLocalStorage(t)
+	defer cleanupSrc()
+	backend, cleanupDst := newTempLocalStorage(t)
+	defer cleanupDst()
+	cacheDir, err := ioutil.TempDir("", "tri-index")
+	if !assert.NoError(err) {
+		t.FailNow()
+	}
+	defer os.RemoveAll(cacheDir)
+	counting := &countingStorage{Storage: backend}
+	// Backups can be written without the private key, the token is readable
+	dst, err := NewHybridEncryptedStorage(counting, []crypt.PublicKey{key.PubKey}, nil)
+	if !assert.NoError(err) {
+		t.FailNow()
+	}
+	opts := SyncOptions{Index: OpenIndex(cacheDir, backend.Root)}
+
+	writeFile(t, src.Root, "file_a", "a")
+	assert.NoError(SyncWithOptions(src, ".", dst, ".", opts))
+	assert.NotZero(counting.lists)
+	token, err := ioutil.ReadFile(filepath.Join(backend.Root, IndexFile))
+	assert.NoError(err)
+	assert.Len(token, 32, "the token should not be encrypted")
+
+	counting.lists = 0
+	writeFile(t, src.Root, "file_b", "b")
+	assert.NoError(SyncWithOptions(src, ".", dst, ".", opts))
+	assert.Zero(counting.lists, "the index should be used")
+	_, err = os.Stat(filepath.Join(backend.Root, "file_b"))
+	assert.NoError(err)
+
+	// The snapshots can't be read, an out of date index still gives the
+	// hashes of the files that didn't change
+	assert.NoError(ioutil.WriteFile(filepath.Join(backend.Root, IndexFile), []byte("other"), 0600))
+	countingSrc := &countingStorage{Storage: src}
+	writeFile(t, src.Root, "file_c", "c")
+	assert.NoError(SyncWithOptions(countingSrc, ".", dst, ".", opts))
+	assert.NotZero(counting.lists)
+	assert.Equal(1, countingSrc.downloads, "only the new file should be read")
+}
@@ -3,6 +3,7 @@ package storage
 import (
 	"io"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
@@ -22,13 +23,25 @@ var (
 	ErrDirectory    = errors.New("path is a directory")
 	ErrNotInRoot    = errors.New("path is not in the root of the given storage")
 	ErrNotExist     = errors.New("path does not exist")
+	ErrReadOnly     = errors.New("storage is read-only")
 )
 
+func init() {
+	Register("file", func(u *url.URL) (Storage, error) {
+		l, err := NewLocalStorage(filepath.FromSlash(u.Path))
+		if err != nil {
+			return nil, err
+		}
+		return l, nil
+	})
+}
+
 // LocalStorage implements Storage for local to a root path
 // It is not safely chrooted to root directory, you should chroot the process
 // if you want more security
 type LocalStorage struct {
-	Root string // Root is an absolute path
+	Root     string // Root is an absolute path
+	readOnly bool   // Writes fail with ErrReadOnly
 }
 
 // NewLocalStorage returns a new local storage at root.
@@ -64,6 +77,28 @@ func NewLocalStorage(root string) (l *LocalStorage, err error) {
 	}, nil
 }
 
+// NewReadOnlyLocalStorage returns a local storage at root that can only be
+// read, like a mounted snapshot or a CD image. It only checks that the
+// directory can be listed
+func NewReadOnlyLocalStorage(root string) (*LocalStorage, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get path")
+	}
+	dir, err := os.Open(root)
+	if err != nil {
+		return nil, errors.Wrap(err, "permissions error")
+	}
+	defer dir.Close()
+	if _, err = dir.Readdirnames(1); err != nil && err != io.EOF {
+		return nil, errors.Wrap(err, "permissions error")
+	}
+	return &LocalStorage{
+		Root:     root,
+		readOnly: true,
+	}, nil
+}
+
 // inRoot checks whether the given path is in the root
 // This is by no mean a secure check, just a convenient one (see chroot)
 func (l *LocalStorage) inRoot(path string) bool {
@@ -112,6 +147,9 @@ func (l *LocalStorage) Mkdir(relative string) error {
 	if !l.inRoot(abs) {
 		return ErrNotInRoot
 	}
+	if l.readOnly {
+		return ErrReadOnly
+	}
 	return os.MkdirAll(abs, defaultDirectoryPerms)
 }
 
@@ -122,6 +160,9 @@ func (l *LocalStorage) Move(src, dst string) error {
 	if !l.inRoot(srcAbs) || !l.inRoot(dstAbs) {
 		return ErrNotInRoot
 	}
+	if l.readOnly {
+		return ErrReadOnly
+	}
 
 	s, err := os.Stat(srcAbs)
 	if err != nil {
@@ -139,6 +180,9 @@ func (l *LocalStorage) Remove(path string) error {
 	if !l.inRoot(abs) {
 		return ErrNotInRoot
 	}
+	if l.readOnly {
+		return ErrReadOnly
+	}
 	return os.Remove(abs)
 }
 
@@ -175,7 +219,10 @@ func (l *LocalStorage) Upload(path string, modTime time.Time) (io.WriteCloser, e
 	if !l.inRoot(abs) {
 		return nil, ErrNotInRoot
 	}
-	f, err := os.OpenFile(abs, os.O_RDWR|os.O_CREATE, defaultPerms)
+	if l.readOnly {
+		return nil, ErrReadOnly
+	}
+	f, err := os.OpenFile(abs, os.O_RDWR|os.O_CREATE|os.O_TRUNC, defaultPerms)
 	return &fileWithModTimeCloser{
 		filePath: abs,
 		file:     f,
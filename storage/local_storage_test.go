@@ -5,6 +5,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
@@ -82,3 +83,39 @@ func TestLocalStorage(t *testing.T) {
 	testStorage := NewStorageTester(localStorage, cleanupTestPath)
 	t.Run("LocalStorage", RunStorageTests(testStorage))
 }
+
+func TestReadOnlyLocalStorage(t *testing.T) {
+	assert := assert.New(t)
+	src, cleanupSrc := newTempLocalStorage(t)
+	defer cleanupSrc()
+	dst, cleanupDst := newTempLocalStorage(t)
+	defer cleanupDst()
+	writeFile(t, src.Root, "folder/file_a", "a")
+	if !assert.NoError(os.Chmod(src.Root, 0555)) {
+		t.FailNow()
+	}
+	defer os.Chmod(src.Root, 0755)
+	if _, err := NewLocalStorage(src.Root); err == nil && os.Geteuid() != 0 {
+		t.Error("a read-only directory should not be a writable storage")
+	}
+
+	s, err := NewReadOnlyLocalStorage(src.Root)
+	if !assert.NoError(err) {
+		t.FailNow()
+	}
+	_, err = s.Upload("file_b", time.Now())
+	assert.Equal(ErrReadOnly, err)
+	assert.Equal(ErrReadOnly, s.Mkdir("folder_b"))
+	assert.Equal(ErrReadOnly, s.Move("folder/file_a", "file_a"))
+	assert.Equal(ErrReadOnly, s.Remove("folder/file_a"))
+	assert.Equal(ErrNotInRoot, errors.Cause(s.Mkdir("..")))
+
+	// It can be a source but not a destination
+	assert.NoError(Sync(s, ".", dst, "."))
+	assert.Equal("a", readFile(t, dst.Root, "folder/file_a"))
+	writeFile(t, dst.Root, "file_c", "c")
+	assert.Error(Sync(dst, ".", s, "."))
+
+	_, err = NewReadOnlyLocalStorage(filepath.Join(src.Root, "missing"))
+	assert.Error(err)
+}
@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Opener returns the storage at a URL of the scheme it is registered for
+type Opener func(u *url.URL) (Storage, error)
+
+var (
+	openersMu sync.RWMutex
+	openers   = make(map[string]Opener)
+)
+
+// Register makes the storages of a URL scheme available to Open. Backends
+// register their scheme in an init function, like database/sql drivers. It
+// panics if the scheme is already registered
+func Register(scheme string, opener Opener) {
+	openersMu.Lock()
+	defer openersMu.Unlock()
+	scheme = strings.ToLower(scheme)
+	if opener == nil {
+		panic("storage: Register opener is nil")
+	}
+	if _, exists := openers[scheme]; exists {
+		panic("storage: Register called twice for scheme " + scheme)
+	}
+	openers[scheme] = opener
+}
+
+// Schemes returns the registered URL schemes, sorted
+func Schemes() []string {
+	openersMu.RLock()
+	defer openersMu.RUnlock()
+	schemes := make([]string, 0, len(openers))
+	for scheme := range openers {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// Open returns the storage at location, a URL (scheme://...) of a registered
+// scheme or a local path
+func Open(location string) (Storage, error) {
+	if !strings.Contains(location, "://") {
+		l, err := NewLocalStorage(location)
+		if err != nil {
+			return nil, err
+		}
+		return l, nil
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid storage url")
+	}
+	openersMu.RLock()
+	opener, ok := openers[strings.ToLower(u.Scheme)]
+	openersMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown storage %s://, expected a local path or one of %s://",
+			u.Scheme, strings.Join(Schemes(), "://, "))
+	}
+	return opener(u)
+}
+
+// OpenReadable returns the storage at location like Open, for reading only.
+// Local paths, and file:// URLs, don't need to be writable
+func OpenReadable(location string) (ReadableStorage, error) {
+	path := location
+	if u, err := url.Parse(location); err == nil && strings.ToLower(u.Scheme) == "file" {
+		path = filepath.FromSlash(u.Path)
+	} else if strings.Contains(location, "://") {
+		return Open(location)
+	}
+	l, err := NewReadOnlyLocalStorage(path)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
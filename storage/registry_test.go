@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry(t *testing.T) {
+	assert := assert.New(t)
+	local, cleanup := newTempLocalStorage(t)
+	defer cleanup()
+	writeFile(t, local.Root, "file_a", "a")
+
+	// Local paths and file:// URLs
+	s, err := Open(local.Root)
+	if assert.NoError(err) {
+		assert.Equal(local.Root, s.(*LocalStorage).Root)
+	}
+	s, err = Open("file://" + local.Root)
+	if assert.NoError(err) {
+		assert.Equal(local.Root, s.(*LocalStorage).Root)
+	}
+
+	// Sources don't need to be writable
+	for _, location := range []string{local.Root, "file://" + local.Root} {
+		r, err := OpenReadable(location)
+		if assert.NoError(err) {
+			_, err = r.(*LocalStorage).Upload("file_b", time.Now())
+			assert.Equal(ErrReadOnly, err)
+		}
+	}
+
+	// Third-party backends
+	var opened *url.URL
+	Register("Test-Registry", func(u *url.URL) (Storage, error) {
+		opened = u
+		return local, nil
+	})
+	s, err = Open("test-registry://host/some/path")
+	assert.NoError(err)
+	assert.Equal(local, s)
+	if assert.NotNil(opened) {
+		assert.Equal("host", opened.Host)
+		assert.Equal("/some/path", opened.Path)
+	}
+	r, err := OpenReadable("test-registry://host/other")
+	assert.NoError(err)
+	assert.Equal(local, r)
+	assert.Panics(func() { Register("test-registry", nil) })
+	assert.Panics(func() {
+		Register("test-registry", func(u *url.URL) (Storage, error) { return nil, nil })
+	}, "a scheme can only be registered once")
+	assert.Subset(Schemes(), []string{"file", "s3", "sftp", "test-registry", "webdav", "webdavs"})
+
+	_, err = Open("unknown://host/path")
+	if assert.Error(err) {
+		assert.True(strings.Contains(err.Error(), "s3://"), "the known schemes should be listed: %s", err)
+	}
+}
+
+func TestRegistryMixedBackends(t *testing.T) {
+	assert := assert.New(t)
+	server, fs := serveWebDAV(t)
+	defer server.Close()
+	if !assert.NoError(resetWebDAV(fs)) {
+		t.FailNow()
+	}
+	os.Setenv(webdavPasswordEnv, "secret")
+	defer os.Unsetenv(webdavPasswordEnv)
+	dst, cleanup := newTempLocalStorage(t)
+	defer cleanup()
+
+	src, err := Open(strings.Replace(server.URL, "http://", "webdav://tri@", 1) + "/dav/backups")
+	if !assert.NoError(err) {
+		t.FailNow()
+	}
+	assert.IsType(&WebDAVStorage{}, src)
+	assert.NoError(Sync(src, ".", dst, "."))
+	assert.Equal("", readFile(t, dst.Root, "folder_a/folder_b/file_b"))
+
+	os.Setenv(webdavPasswordEnv, "wrong")
+	_, err = Open(strings.Replace(server.URL, "http://", "webdav://tri@", 1) + "/dav/backups")
+	assert.Error(err)
+}
@@ -0,0 +1,386 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// RepositoryFile marks the root of a Repository and holds its parameters
+	RepositoryFile = ".tri-repository"
+	// ChunksDirectory is the directory, at the root of a Repository, where
+	// the chunks are stored
+	ChunksDirectory = "chunks"
+
+	repositoryVersion = 1
+	chunkTempSuffix   = ".tmp"
+	chunkKeySize      = 32
+)
+
+// ErrNotRepository is returned when opening a Repository where there is none
+var ErrNotRepository = errors.New("not a tri repository")
+
+type repositoryConfig struct {
+	Version int           `json:"version"`
+	Chunker ChunkerParams `json:"chunker"`
+	// ChunkKey keys the chunk hashes of an encrypted repository, so the
+	// names of the chunks don't reveal which content is stored. It is only
+	// readable with the key of the repository since the config is encrypted
+	ChunkKey []byte `json:"chunk_key,omitempty"`
+}
+
+// Repository stores deduplicated snapshots of a source in a Storage. Files are
+// split in content-defined chunks, each chunk is stored once under its hash
+// (ChunksDirectory/<2 first characters>/<hash>) and the snapshots (see
+// Snapshot) record the list of chunks of each file. So files that are
+// copied, moved or unchanged between two backups cost nothing
+type Repository struct {
+	s      Storage
+	root   string
+	config repositoryConfig
+	atomic bool // See hasAtomicUploads
+}
+
+// BackupStats sums up what a Backup stored
+type BackupStats struct {
+	Files     int   // Files in the snapshot
+	Chunks    int   // Chunks read from the files that changed
+	NewChunks int   // Chunks that were not in the repository yet
+	NewBytes  int64 // Size of the new chunks
+}
+
+// IsRepository returns whether there is a Repository at root in s
+func IsRepository(s Storage, root string) (bool, error) {
+	listing, err := s.List(root)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to list "+root)
+	}
+	_, ok := findObject(listing, RepositoryFile)
+	return ok, nil
+}
+
+// InitRepository creates an empty Repository at root in s
+func InitRepository(s Storage, root string, params ChunkerParams) (*Repository, error) {
+	if !params.valid() {
+		return nil, ErrInvalidChunkerParams
+	}
+	if err := s.Mkdir(root); err != nil {
+		return nil, errors.Wrap(err, "failed to create directory "+root)
+	}
+	exists, err := IsRepository(s, root)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, errors.Wrap(ErrAlreadyExist, root)
+	}
+	config := repositoryConfig{Version: repositoryVersion, Chunker: params}
+	if _, encrypted := s.(*EncryptedStorage); encrypted {
+		config.ChunkKey = make([]byte, chunkKeySize)
+		if _, err = rand.Read(config.ChunkKey); err != nil {
+			return nil, errors.Wrap(err, "failed to generate chunk key")
+		}
+	}
+	content, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	w, err := s.Upload(root+"/"+RepositoryFile, now())
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create repository")
+	}
+	_, err = w.Write(content)
+	err2 := w.Close()
+	if err == nil {
+		err = err2
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create repository")
+	}
+	return &Repository{s: s, root: root, config: config, atomic: hasAtomicUploads(s)}, nil
+}
+
+// OpenRepository returns the Repository at root in s
+func OpenRepository(s Storage, root string) (*Repository, error) {
+	exists, err := IsRepository(s, root)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errors.Wrap(ErrNotRepository, root)
+	}
+	r, err := s.Download(root + "/" + RepositoryFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open repository")
+	}
+	defer r.Close()
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read repository")
+	}
+	var config repositoryConfig
+	if err = json.Unmarshal(content, &config); err != nil {
+		return nil, errors.Wrap(err, "failed to parse repository")
+	}
+	if config.Version != repositoryVersion {
+		return nil, errors.Errorf("unsupported repository version %d", config.Version)
+	}
+	if !config.Chunker.valid() {
+		return nil, ErrInvalidChunkerParams
+	}
+	if _, encrypted := s.(*EncryptedStorage); encrypted && len(config.ChunkKey) != chunkKeySize {
+		return nil, errors.New("encrypted repository without chunk key")
+	}
+	return &Repository{s: s, root: root, config: config, atomic: hasAtomicUploads(s)}, nil
+}
+
+// chunkHash returns the hash naming chunk: its SHA-256, keyed with an HMAC in
+// an encrypted repository
+func (r *Repository) chunkHash(chunk []byte) string {
+	if r.config.ChunkKey == nil {
+		sum := sha256.Sum256(chunk)
+		return hex.EncodeToString(sum[:])
+	}
+	mac := hmac.New(sha256.New, r.config.ChunkKey)
+	mac.Write(chunk)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// chunkPath returns the path of the chunk with the given hash
+func (r *Repository) chunkPath(hash string) string {
+	return r.root + "/" + ChunksDirectory + "/" + hash[:2] + "/" + hash
+}
+
+// knownChunks returns the hashes of the chunks in the repository
+func (r *Repository) knownChunks() (map[string]bool, error) {
+	known := make(map[string]bool)
+	listing, err := r.s.List(r.root)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list repository")
+	}
+	if _, ok := findObject(listing, ChunksDirectory); !ok {
+		return known, nil
+	}
+	// Only the names are needed, a listing with the modification times can
+	// take a request per chunk
+	tree, err := GetTree(namesOnly{r.s}, StoreObject{IsDirectory: true}, r.root+"/"+ChunksDirectory)
+	if err != nil {
+		return nil, err
+	}
+	for _, prefix := range tree.Children {
+		for _, c := range prefix.Children {
+			if !c.IsDirectory && !strings.HasSuffix(c.Name, chunkTempSuffix) {
+				known[c.Name] = true
+			}
+		}
+	}
+	return known, nil
+}
+
+// putChunk stores a chunk. Unless the uploads of the storage are atomic, it
+// is written to a temporary file first so an interrupted backup never leaves
+// a truncated chunk
+func (r *Repository) putChunk(hash string, chunk []byte) error {
+	p := r.chunkPath(hash)
+	if err := r.s.Mkdir(path.Dir(p)); err != nil {
+		return errors.Wrap(err, "failed to create directory "+path.Dir(p))
+	}
+	uploadPath := p
+	if !r.atomic {
+		uploadPath += chunkTempSuffix
+	}
+	w, err := r.s.Upload(uploadPath, now())
+	if err != nil {
+		return errors.Wrap(err, "failed to open chunk "+hash)
+	}
+	_, err = w.Write(chunk)
+	err2 := w.Close()
+	if err == nil {
+		err = err2
+	}
+	if err == nil && uploadPath != p {
+		err = r.s.Move(uploadPath, p)
+	}
+	return errors.Wrap(err, "failed to write chunk "+hash)
+}
+
+// storeFile stores the chunks of the file at p in src that are not known
+// yet, it returns the hash of the file and the list of its chunks
+func (r *Repository) storeFile(src ReadableStorage, p string, known map[string]bool, stats *BackupStats) (string, []string, error) {
+	f, err := src.Download(p)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "failed to open "+p)
+	}
+	defer f.Close()
+	fileHash := sha256.New()
+	c := newChunker(io.TeeReader(f, fileHash), r.config.Chunker)
+	var chunks []string
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", nil, errors.Wrap(err, "failed to read "+p)
+		}
+		hash := r.chunkHash(chunk)
+		chunks = append(chunks, hash)
+		stats.Chunks++
+		if known[hash] {
+			continue
+		}
+		if err = r.putChunk(hash, chunk); err != nil {
+			return "", nil, err
+		}
+		known[hash] = true
+		stats.NewChunks++
+		stats.NewBytes += int64(len(chunk))
+	}
+	return hex.EncodeToString(fileHash.Sum(nil)), chunks, nil
+}
+
+// Backup stores a new snapshot of srcRoot in src. The files whose size and
+// modification time didn't change since the latest snapshot are not read
+func (r *Repository) Backup(src ReadableStorage, srcRoot string) (Snapshot, BackupStats, error) {
+	var stats BackupStats
+	used, err := usedGenerations(r.s, r.root)
+	if err != nil {
+		return Snapshot{}, stats, err
+	}
+	t := generationTime(now(), func(id string) bool { return used[id] })
+	tree, err := GetTree(src, StoreObject{IsDirectory: true}, srcRoot)
+	if err != nil {
+		return Snapshot{}, stats, err
+	}
+	known, err := r.knownChunks()
+	if err != nil {
+		return Snapshot{}, stats, err
+	}
+	previous, _, err := latestSnapshot(r.s, r.root)
+	if err != nil {
+		return Snapshot{}, stats, err
+	}
+
+	var walk func(n SyncNode, relative string) (SyncNode, error)
+	walk = func(n SyncNode, relative string) (SyncNode, error) {
+		if !n.IsDirectory {
+			stats.Files++
+			if p, ok := lookupNode(previous, relative); ok && p.Hash != "" && sameContent(p.StoreObject, n.StoreObject) && allKnown(p.Chunks, known) {
+				n.Hash, n.Chunks = p.Hash, p.Chunks
+				return n, nil
+			}
+			log.Infof("Storing %s", relative)
+			hash, chunks, err := r.storeFile(src, srcRoot+"/"+relative, known, &stats)
+			n.Hash, n.Chunks = hash, chunks
+			return n, err
+		}
+		children := make([]SyncNode, len(n.Children))
+		for i, c := range n.Children {
+			child, err := walk(c, path.Join(relative, c.Name))
+			if err != nil {
+				return SyncNode{}, err
+			}
+			children[i] = child
+		}
+		n.Children = children
+		return n, nil
+	}
+	tree, err = walk(withoutReserved(tree), "")
+	if err != nil {
+		return Snapshot{}, stats, err
+	}
+	snapshot := Snapshot{
+		ID:   t.Format(binTimeFormat),
+		Time: t,
+		Tree: tree,
+	}
+	return snapshot, stats, writeSnapshot(r.s, r.root, snapshot)
+}
+
+// allKnown returns whether all the chunks are in known
+func allKnown(chunks []string, known map[string]bool) bool {
+	for _, c := range chunks {
+		if !known[c] {
+			return false
+		}
+	}
+	return true
+}
+
+// Restore writes the files of a snapshot to dstRoot in dst, see
+// RestoreOptions. The latest snapshot is restored if opts.Snapshot is empty
+func (r *Repository) Restore(dst Storage, dstRoot string, opts RestoreOptions) (SyncNode, error) {
+	id := opts.Snapshot
+	if id == "" {
+		ids, err := Snapshots(r.s, r.root)
+		if err != nil {
+			return SyncNode{}, err
+		}
+		if len(ids) == 0 {
+			return SyncNode{}, errors.Wrap(ErrNotExist, "no snapshot in the repository")
+		}
+		id = ids[len(ids)-1]
+	}
+	snapshot, err := ReadSnapshot(r.s, r.root, id)
+	if err != nil {
+		return SyncNode{}, err
+	}
+	tree, err := selectPattern(snapshot.Tree, opts.Pattern)
+	if err != nil {
+		return SyncNode{}, err
+	}
+	open := func(relative string, n SyncNode) (io.ReadCloser, error) {
+		return &chunksReader{r: r, chunks: n.Chunks}, nil
+	}
+	return tree, restoreFiles(tree, dst, dstRoot, opts.Overwrite, open)
+}
+
+// chunksReader reads the concatenation of chunks of a Repository
+type chunksReader struct {
+	r       *Repository
+	chunks  []string
+	current io.ReadCloser
+}
+
+func (c *chunksReader) Read(p []byte) (int, error) {
+	for {
+		if c.current == nil {
+			if len(c.chunks) == 0 {
+				return 0, io.EOF
+			}
+			chunk, err := c.r.s.Download(c.r.chunkPath(c.chunks[0]))
+			if err != nil {
+				return 0, errors.Wrap(err, "failed to open chunk "+c.chunks[0])
+			}
+			c.current = chunk
+			c.chunks = c.chunks[1:]
+		}
+		n, err := c.current.Read(p)
+		if err == io.EOF {
+			c.current.Close()
+			c.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *chunksReader) Close() error {
+	if c.current == nil {
+		return nil
+	}
+	return c.current.Close()
+}
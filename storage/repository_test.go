@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRepository(t *testing.T) {
+	assert := assert.New(t)
+	src, cleanupSrc := newTempLocalStorage(t)
+	defer cleanupSrc()
+	dst, cleanupDst := newTempLocalStorage(t)
+	defer cleanupDst()
+	target, cleanupTarget := newTempLocalStorage(t)
+	defer cleanupTarget()
+	defer func() { now = time.Now }()
+	now = func() time.Time { return time.Date(2017, time.May, 17, 20, 1, 0, 0, time.UTC) }
+
+	_, err := OpenRepository(dst, ".")
+	assert.Equal(ErrNotRepository, errors.Cause(err))
+	_, err = InitRepository(dst, ".", ChunkerParams{})
+	assert.Equal(ErrInvalidChunkerParams, err)
+	repo, err := InitRepository(dst, ".", testChunkerParams)
+	if !assert.NoError(err) {
+		t.FailNow()
+	}
+	_, err = InitRepository(dst, ".", testChunkerParams)
+	assert.Equal(ErrAlreadyExist, errors.Cause(err))
+	repo, err = OpenRepository(dst, ".")
+	assert.NoError(err)
+
+	// The parameters read back are checked, chunks are read in memory
+	config := readFile(t, dst.Root, RepositoryFile)
+	writeFile(t, dst.Root, RepositoryFile, `{"version":1,"chunker":{"min_size":256,"avg_bits":10,"max_size":1099511627776}}`)
+	_, err = OpenRepository(dst, ".")
+	assert.Equal(ErrInvalidChunkerParams, err)
+	writeFile(t, dst.Root, RepositoryFile, config)
+
+	data := make([]byte, 64<<10)
+	rand.New(rand.NewSource(42)).Read(data)
+	writeFile(t, src.Root, "folder_a/file_a", string(data))
+	writeFile(t, src.Root, "file_b", "b")
+	writeFile(t, src.Root, "empty", "")
+	snapshot1, stats, err := repo.Backup(src, ".")
+	if !assert.NoError(err) {
+		t.FailNow()
+	}
+	assert.Equal(3, stats.Files)
+	assert.Equal(stats.Chunks, stats.NewChunks)
+	assert.Equal(int64(len(data)+1), stats.NewBytes)
+
+	// Copies and moves don't store anything new
+	now = func() time.Time { return time.Date(2017, time.May, 17, 20, 2, 0, 0, time.UTC) }
+	assert.NoError(os.Rename(filepath.Join(src.Root, "folder_a"), filepath.Join(src.Root, "folder_moved")))
+	writeFile(t, src.Root, "copy_a", string(data))
+	_, stats, err = repo.Backup(src, ".")
+	assert.NoError(err)
+	assert.Equal(4, stats.Files)
+	assert.Equal(0, stats.NewChunks)
+	assert.True(stats.Chunks > 0)
+
+	// Unchanged files are not even read, an edit only stores the chunks around it
+	now = func() time.Time { return time.Date(2017, time.May, 17, 20, 3, 0, 0, time.UTC) }
+	edited := append([]byte{}, data...)
+	copy(edited[30000:], "edited")
+	writeFile(t, src.Root, "copy_a", string(edited))
+	_, stats, err = repo.Backup(src, ".")
+	assert.NoError(err)
+	assert.Equal(len(chunkAll(t, edited, testChunkerParams)), stats.Chunks)
+	assert.True(stats.NewChunks > 0 && stats.NewChunks <= 2, "%d new chunks", stats.NewChunks)
+	assert.True(stats.NewBytes < int64(len(data)/4))
+
+	ids, err := Snapshots(dst, ".")
+	assert.NoError(err)
+	assert.Len(ids, 3)
+
+	// Any snapshot can be restored, the latest by default
+	_, err = repo.Restore(target, "latest", RestoreOptions{})
+	assert.NoError(err)
+	assert.Equal(string(edited), readFile(t, target.Root, "latest/copy_a"))
+	assert.Equal(string(data), readFile(t, target.Root, "latest/folder_moved/file_a"))
+	assert.Equal("b", readFile(t, target.Root, "latest/file_b"))
+	_, err = os.Stat(filepath.Join(target.Root, "latest/empty"))
+	assert.NoError(err)
+	_, err = repo.Restore(target, "first", RestoreOptions{Snapshot: snapshot1.ID, Pattern: "folder_a"})
+	assert.NoError(err)
+	assert.Equal(string(data), readFile(t, target.Root, "first/folder_a/file_a"))
+	assert.Equal("", readFile(t, target.Root, "first/file_b"))
+
+	// Chunks are checked
+	node, _ := lookupNode(snapshot1.Tree, "folder_a/file_a")
+	chunkPath := filepath.Join(dst.Root, filepath.FromSlash(repo.chunkPath(node.Chunks[0])))
+	assert.NoError(ioutil.WriteFile(chunkPath, []byte("tampered"), 0660))
+	_, err = repo.Restore(target, "tampered", RestoreOptions{Snapshot: snapshot1.ID})
+	assert.Equal(ErrSnapshotMismatch, errors.Cause(err))
+}
+
+func TestRepositoryEncrypted(t *testing.T) {
+	assert := assert.New(t)
+	src, cleanupSrc := newTempLocalStorage(t)
+	defer cleanupSrc()
+	backend, cleanupBackend := newTempLocalStorage(t)
+	defer cleanupBackend()
+	target, cleanupTarget := newTempLocalStorage(t)
+	defer cleanupTarget()
+	dst, err := NewEncryptedStorage(backend, []byte("super secret 🍣"))
+	assert.NoError(err)
+	repo, err := InitRepository(dst, ".", testChunkerParams)
+	if !assert.NoError(err) {
+		t.FailNow()
+	}
+
+	// The chunks are not named after the plain hash of their content
+	writeFile(t, src.Root, "file_a", "a")
+	snapshot, _, err := repo.Backup(src, ".")
+	if !assert.NoError(err) {
+		t.FailNow()
+	}
+	node, _ := lookupNode(snapshot.Tree, "file_a")
+	// sha256 of "a"
+	plain := "ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb"
+	if assert.Len(node.Chunks, 1) {
+		assert.NotEqual(plain, node.Chunks[0])
+	}
+	assert.Equal(plain, node.Hash)
+
+	// The key is kept in the encrypted repository
+	repo, err = OpenRepository(dst, ".")
+	if !assert.NoError(err) {
+		t.FailNow()
+	}
+	assert.Equal(node.Chunks[0], repo.chunkHash([]byte("a")))
+	_, err = repo.Restore(target, "restored", RestoreOptions{})
+	assert.NoError(err)
+	assert.Equal("a", readFile(t, target.Root, "restored/file_a"))
+
+	// Another repository gets another key
+	other, cleanupOther := newTempLocalStorage(t)
+	defer cleanupOther()
+	otherDst, err := NewEncryptedStorage(other, []byte("super secret 🍣"))
+	assert.NoError(err)
+	otherRepo, err := InitRepository(otherDst, ".", testChunkerParams)
+	assert.NoError(err)
+	assert.NotEqual(node.Chunks[0], otherRepo.chunkHash([]byte("a")))
+}
@@ -0,0 +1,171 @@
+package storage
+
+import (
+	"io"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// RestoreOptions tunes the behavior of Restore
+type RestoreOptions struct {
+	// Pattern limits the restore to the files whose path relative to the
+	// backup root, or the path of one of their parent directories, matches
+	// it (see path.Match). So it can be a sub-path or a glob, everything is
+	// restored if it is empty
+	Pattern string
+	// Overwrite allows replacing the files already in the target
+	Overwrite bool
+	// Snapshot, if set, is the ID of the snapshot (see Snapshots) to restore
+	// instead of the current state of the backup
+	Snapshot string
+}
+
+// selectTree returns the nodes of n matching pattern (see RestoreOptions),
+// relative being the path of n
+func selectTree(n SyncNode, relative, pattern string) SyncNode {
+	if ok, _ := path.Match(pattern, relative); ok || pattern == "" {
+		return n
+	}
+	if !n.IsDirectory {
+		return SyncNode{}
+	}
+	children := make([]SyncNode, 0, len(n.Children))
+	for _, c := range n.Children {
+		selected := selectTree(c, path.Join(relative, c.Name), pattern)
+		if !selected.IsZero() {
+			children = append(children, selected)
+		}
+	}
+	if len(children) == 0 {
+		return SyncNode{}
+	}
+	return SyncNode{StoreObject: n.StoreObject, Children: children}
+}
+
+// checkRestore returns ErrAlreadyExist if restoring n over existing, at
+// dstPath, would replace a file (unless overwrite) or a directory by a file
+func checkRestore(n, existing SyncNode, dstPath string, overwrite bool) error {
+	existingChildren := make(map[string]SyncNode, len(existing.Children))
+	for _, c := range existing.Children {
+		existingChildren[c.Name] = c
+	}
+	for _, c := range n.Children {
+		e, ok := existingChildren[c.Name]
+		if !ok {
+			continue
+		}
+		p := dstPath + "/" + c.Name
+		switch {
+		case c.IsDirectory && e.IsDirectory:
+			if err := checkRestore(c, e, p, overwrite); err != nil {
+				return err
+			}
+		case c.IsDirectory || e.IsDirectory || !overwrite:
+			return errors.Wrap(ErrAlreadyExist, p)
+		}
+	}
+	return nil
+}
+
+// Restore copies the files of the backup at srcRoot in src, as written by
+// Sync (the bin excepted), to dstRoot in dst with their modification time.
+// Nothing is copied if a file is in the way, unless opts.Overwrite is set.
+// When restoring a snapshot, the content of the files that changed since
+// is taken from the bin. It returns the tree of the restored files
+func Restore(src Storage, srcRoot string, dst Storage, dstRoot string, opts RestoreOptions) (SyncNode, error) {
+	var tree SyncNode
+	var sources map[string]string
+	var err error
+	if opts.Snapshot != "" {
+		var snapshot Snapshot
+		snapshot, err = ReadSnapshot(src, srcRoot, opts.Snapshot)
+		tree = snapshot.Tree
+	} else {
+		tree, err = GetTree(src, StoreObject{IsDirectory: true}, srcRoot)
+	}
+	if err != nil {
+		return SyncNode{}, err
+	}
+	tree, err = selectPattern(withoutReserved(tree), opts.Pattern)
+	if err != nil {
+		return SyncNode{}, err
+	}
+	if opts.Snapshot != "" {
+		sources, err = snapshotSources(src, srcRoot, Snapshot{Tree: tree})
+		if err != nil {
+			return SyncNode{}, err
+		}
+	}
+	open := func(relative string, n SyncNode) (io.ReadCloser, error) {
+		srcPath, ok := sources[relative]
+		if !ok {
+			srcPath = srcRoot + "/" + relative
+		}
+		r, err := src.Download(srcPath)
+		return r, errors.Wrap(err, "failed to open "+srcPath)
+	}
+	return tree, restoreFiles(tree, dst, dstRoot, opts.Overwrite, open)
+}
+
+// selectPattern returns the nodes of tree matching pattern (see RestoreOptions)
+func selectPattern(tree SyncNode, pattern string) (SyncNode, error) {
+	cleaned := strings.Trim(path.Clean("/"+pattern), "/")
+	if _, err := path.Match(cleaned, ""); err != nil {
+		return SyncNode{}, errors.Wrap(err, "invalid pattern "+pattern)
+	}
+	tree = selectTree(tree, "", cleaned)
+	if tree.IsZero() {
+		return SyncNode{}, errors.Wrap(ErrNotExist, "nothing matches "+pattern)
+	}
+	return tree, nil
+}
+
+// restoreFiles writes the files of tree to dstRoot in dst, open returning
+// the content of each of them. Nothing is written if a file is in the way,
+// unless overwrite is set. Hashes are checked when they are known
+func restoreFiles(tree SyncNode, dst Storage, dstRoot string, overwrite bool, open func(relative string, n SyncNode) (io.ReadCloser, error)) error {
+	if err := dst.Mkdir(dstRoot); err != nil {
+		return errors.Wrap(err, "failed to create directory "+dstRoot)
+	}
+	existing, err := GetTree(dst, StoreObject{IsDirectory: true}, dstRoot)
+	if err != nil {
+		return err
+	}
+	if err = checkRestore(tree, existing, dstRoot, overwrite); err != nil {
+		return err
+	}
+
+	var walk func(n SyncNode, relative string) error
+	walk = func(n SyncNode, relative string) error {
+		dstPath := dstRoot + "/" + relative
+		if !n.IsDirectory {
+			log.Infof("Restoring %s", dstPath)
+			r, err := open(relative, n)
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			hash, err := uploadFile(r, dst, dstPath, n.Modified)
+			if err != nil {
+				return errors.Wrap(err, "failed to restore "+relative)
+			}
+			if n.Hash != "" && hash != n.Hash {
+				return errors.Wrap(ErrSnapshotMismatch, relative)
+			}
+			return nil
+		}
+		if err := dst.Mkdir(dstPath); err != nil {
+			return errors.Wrap(err, "failed to create directory "+dstPath)
+		}
+		for _, c := range n.Children {
+			if err := walk(c, path.Join(relative, c.Name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return walk(tree, "")
+}
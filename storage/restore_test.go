@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// readFile returns the content of the file at path in root, or "" if it doesn't exist
+func readFile(t *testing.T, root, path string) string {
+	content, err := ioutil.ReadFile(filepath.Join(root, filepath.FromSlash(path)))
+	if os.IsNotExist(err) {
+		return ""
+	}
+	if err != nil {
+		t.Fatalf("Failed to read %s: %s", path, err)
+	}
+	return string(content)
+}
+
+func TestRestore(t *testing.T) {
+	assert := assert.New(t)
+	src, cleanupSrc := newTempLocalStorage(t)
+	defer cleanupSrc()
+	backend, cleanupBackup := newTempLocalStorage(t)
+	defer cleanupBackup()
+	target, cleanupTarget := newTempLocalStorage(t)
+	defer cleanupTarget()
+
+	writeFile(t, src.Root, "file_a", "a")
+	writeFile(t, src.Root, "folder_a/file_aa", "aa")
+	writeFile(t, src.Root, "folder_a/file_ab.txt", "ab")
+	writeFile(t, src.Root, "folder_b/file_ba.txt", "ba")
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	assert.NoError(os.Chtimes(filepath.Join(src.Root, "file_a"), modTime, modTime))
+	backup, err := NewEncryptedStorage(backend, []byte("passphrase"))
+	assert.NoError(err)
+	assert.NoError(Sync(src, ".", backup, "."))
+	writeFile(t, src.Root, "file_a", "a2") // Put file_a in the bin
+	assert.NoError(os.Chtimes(filepath.Join(src.Root, "file_a"), modTime, modTime.Add(time.Hour)))
+	assert.NoError(os.RemoveAll(filepath.Join(src.Root, "folder_b")))
+	assert.NoError(Sync(src, ".", backup, "."))
+
+	// Sub-path
+	restored, err := Restore(backup, ".", target, "sub", RestoreOptions{Pattern: "folder_a/file_aa"})
+	assert.NoError(err)
+	assert.Len(restored.Children, 1)
+	assert.Equal("aa", readFile(t, target.Root, "sub/folder_a/file_aa"))
+	assert.Equal("", readFile(t, target.Root, "sub/folder_a/file_ab.txt"))
+
+	// Glob, matching on directories restores everything in them
+	_, err = Restore(backup, ".", target, "glob", RestoreOptions{Pattern: "*/*.txt"})
+	assert.NoError(err)
+	assert.Equal("ab", readFile(t, target.Root, "glob/folder_a/file_ab.txt"))
+	assert.Equal("", readFile(t, target.Root, "glob/folder_a/file_aa"))
+	_, err = Restore(backup, ".", target, "dir", RestoreOptions{Pattern: "folder_*"})
+	assert.NoError(err)
+	assert.Equal("aa", readFile(t, target.Root, "dir/folder_a/file_aa"))
+	assert.Equal("ab", readFile(t, target.Root, "dir/folder_a/file_ab.txt"))
+
+	_, err = Restore(backup, ".", target, "none", RestoreOptions{Pattern: "folder_b"})
+	assert.Equal(ErrNotExist, errors.Cause(err))
+	_, err = Restore(backup, ".", target, "none", RestoreOptions{Pattern: "["})
+	assert.Error(err)
+
+	// Everything, decrypted, without the bin and with modification times
+	_, err = Restore(backup, ".", target, "all", RestoreOptions{})
+	assert.NoError(err)
+	assert.Equal("a2", readFile(t, target.Root, "all/file_a"))
+	assert.Equal("aa", readFile(t, target.Root, "all/folder_a/file_aa"))
+	_, err = os.Stat(filepath.Join(target.Root, "all", BinDirectory))
+	assert.True(os.IsNotExist(err))
+	info, err := os.Stat(filepath.Join(target.Root, "all/file_a"))
+	if assert.NoError(err) {
+		assert.True(modTime.Add(time.Hour).Equal(info.ModTime()))
+	}
+
+	// Existing files are only replaced when asked, nothing is copied otherwise
+	writeFile(t, target.Root, "all/file_a", "mine")
+	assert.NoError(os.Remove(filepath.Join(target.Root, "all/folder_a/file_aa")))
+	_, err = Restore(backup, ".", target, "all", RestoreOptions{})
+	assert.Equal(ErrAlreadyExist, errors.Cause(err))
+	assert.Equal("mine", readFile(t, target.Root, "all/file_a"))
+	assert.Equal("", readFile(t, target.Root, "all/folder_a/file_aa"))
+	_, err = Restore(backup, ".", target, "all", RestoreOptions{Overwrite: true})
+	assert.NoError(err)
+	assert.Equal("a2", readFile(t, target.Root, "all/file_a"))
+	assert.Equal("aa", readFile(t, target.Root, "all/folder_a/file_aa"))
+
+	// A directory is never replaced by a file
+	assert.NoError(os.Remove(filepath.Join(target.Root, "all/file_a")))
+	assert.NoError(os.Mkdir(filepath.Join(target.Root, "all/file_a"), 0770))
+	_, err = Restore(backup, ".", target, "all", RestoreOptions{Overwrite: true})
+	assert.Equal(ErrAlreadyExist, errors.Cause(err))
+}
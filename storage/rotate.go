@@ -0,0 +1,175 @@
+package storage
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Viq111/tri/crypt"
+)
+
+const (
+	// KeyMetadataFile is the file, at the root of a destination, where the key
+	// rotations are recorded
+	KeyMetadataFile = ".tri-keys.json"
+	// rotateSuffix is appended to the name of a key file while it is re-wrapped
+	rotateSuffix = ".tri-rotate"
+)
+
+// KeyRotation records a rotation done by RotateKey
+type KeyRotation struct {
+	Time    time.Time `json:"time"`
+	Old     string    `json:"old"`     // Fingerprint of the replaced key
+	New     string    `json:"new"`     // Fingerprint of the new key
+	Keys    int       `json:"keys"`    // Key files re-wrapped
+	Skipped int       `json:"skipped"` // Key files that were not for the old key
+}
+
+// KeyMetadata is the content of KeyMetadataFile
+type KeyMetadata struct {
+	Rotations []KeyRotation `json:"rotations"`
+}
+
+// keyStorage returns the storage where the key files and the key metadata of
+// the destination s are kept: at the root of the backend of an
+// EncryptedStorage, the same for all the roots in it
+func keyStorage(s Storage) Storage {
+	if e, ok := s.(*EncryptedStorage); ok {
+		return e.backend
+	}
+	return s
+}
+
+// ReadKeyMetadata returns the key metadata of the destination s, an
+// EncryptedStorage or its backend
+func ReadKeyMetadata(s Storage) (KeyMetadata, error) {
+	var metadata KeyMetadata
+	s, root := keyStorage(s), "."
+	listing, err := s.List(root)
+	if err != nil {
+		return metadata, errors.Wrap(err, "failed to list "+root)
+	}
+	if _, ok := findObject(listing, KeyMetadataFile); !ok {
+		return metadata, nil
+	}
+	r, err := s.Download(root + "/" + KeyMetadataFile)
+	if err != nil {
+		return metadata, errors.Wrap(err, "failed to open key metadata")
+	}
+	defer r.Close()
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return metadata, errors.Wrap(err, "failed to read key metadata")
+	}
+	err = json.Unmarshal(content, &metadata)
+	return metadata, errors.Wrap(err, "failed to parse key metadata")
+}
+
+// writeKeyMetadata writes the key metadata of the destination at root in s
+func writeKeyMetadata(s Storage, root string, metadata KeyMetadata) error {
+	content, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return err
+	}
+	w, err := s.Upload(root+"/"+KeyMetadataFile, now())
+	if err != nil {
+		return errors.Wrap(err, "failed to open key metadata")
+	}
+	_, err = w.Write(content)
+	err2 := w.Close()
+	if err == nil {
+		err = err2
+	}
+	return errors.Wrap(err, "failed to write key metadata")
+}
+
+// rewrapKeyFile re-wraps the data key of the key file at path from old to
+// newKey, it returns crypt.ErrNotRecipient if the key was not wrapped for old
+func rewrapKeyFile(s Storage, n StoreObject, path string, old crypt.PrivateKey, newKey crypt.PublicKey) error {
+	r, err := s.Download(path)
+	if err != nil {
+		return errors.Wrap(err, "failed to open "+path)
+	}
+	keyFile, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return errors.Wrap(err, "failed to read "+path)
+	}
+	rewrapped, err := crypt.RewrapHybridKey(old, newKey, keyFile)
+	if err != nil {
+		return err
+	}
+
+	// Replace it at once so an interrupted rotation doesn't lose the key
+	tmpPath := path + rotateSuffix
+	w, err := s.Upload(tmpPath, n.Modified)
+	if err != nil {
+		return errors.Wrap(err, "failed to open "+tmpPath)
+	}
+	_, err = w.Write(rewrapped)
+	err2 := w.Close()
+	if err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = s.Move(tmpPath, path)
+	}
+	if err != nil {
+		s.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// RotateKey replaces, in every key file of the destination s, the data key
+// wrapped for old by one wrapped for newKey (see NewHybridEncryptedStorage).
+// Only the key files are rewritten, the encrypted files are left as is. s is
+// the EncryptedStorage of the destination or its backend. The rotation is
+// recorded in the KeyMetadataFile of the destination
+func RotateKey(s Storage, old crypt.PrivateKey, newKey crypt.PublicKey) (KeyRotation, error) {
+	rotation := KeyRotation{
+		Time: now().UTC(),
+		Old:  old.PubKey.Fingerprint(),
+		New:  newKey.Fingerprint(),
+	}
+	s, root := keyStorage(s), "."
+	listing, err := s.List(root)
+	if err != nil {
+		return rotation, errors.Wrap(err, "failed to list "+root)
+	}
+	if _, ok := findObject(listing, DataKeyDirectory); ok {
+		keysPath := DataKeyDirectory
+		keys, err := s.List(keysPath)
+		if err != nil {
+			return rotation, errors.Wrap(err, "failed to list "+keysPath)
+		}
+		for _, k := range keys {
+			if k.IsDirectory || strings.HasSuffix(k.Name, rotateSuffix) {
+				continue
+			}
+			path := keysPath + "/" + k.Name
+			err := rewrapKeyFile(s, k, path, old, newKey)
+			switch errors.Cause(err) {
+			case nil:
+				log.Infof("Re-wrapped %s", path)
+				rotation.Keys++
+			case crypt.ErrNotRecipient:
+				log.Infof("Skipping %s: not wrapped for the old key", path)
+				rotation.Skipped++
+			default:
+				return rotation, errors.Wrap(err, "failed to re-wrap "+path)
+			}
+		}
+	}
+
+	metadata, err := ReadKeyMetadata(s)
+	if err != nil {
+		return rotation, err
+	}
+	metadata.Rotations = append(metadata.Rotations, rotation)
+	return rotation, writeKeyMetadata(s, root, metadata)
+}
@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Viq111/tri/crypt"
+)
+
+func TestRotateKey(t *testing.T) {
+	if testing.Short() { // Key generation is slow, skip is we want fast
+		t.Skip()
+	}
+	assert := assert.New(t)
+	oldKey, err := crypt.GenerateNewKey("old", 1024)
+	if !assert.NoError(err) {
+		t.FailNow()
+	}
+	newKey, err := crypt.GenerateNewKey("new", 1024)
+	if !assert.NoError(err) {
+		t.FailNow()
+	}
+	src, cleanupSrc := newTempLocalStorage(t)
+	defer cleanupSrc()
+	backend, cleanupDst := newTempLocalStorage(t)
+	defer cleanupDst()
+	writeFile(t, src.Root, "file_a", "Hello World!")
+	writeFile(t, src.Root, "folder/file_b", "🍣")
+
+	oldStorage, err := NewHybridEncryptedStorage(backend, []crypt.PublicKey{oldKey.PubKey}, &oldKey)
+	assert.NoError(err)
+	assert.NoError(Sync(src, ".", oldStorage, "."))
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	assert.NoError(os.Chtimes(filepath.Join(backend.Root, "file_a"), modTime, modTime))
+	before, err := ioutil.ReadFile(filepath.Join(backend.Root, "file_a"))
+	assert.NoError(err)
+
+	keys, err := ioutil.ReadDir(filepath.Join(backend.Root, DataKeyDirectory))
+	assert.NoError(err)
+	assert.Len(keys, 1, "a sync should use a single data key")
+
+	rotation, err := RotateKey(backend, oldKey, newKey.PubKey)
+	if !assert.NoError(err) {
+		t.FailNow()
+	}
+	assert.Equal(1, rotation.Keys)
+	assert.Equal(0, rotation.Skipped)
+	assert.Equal(oldKey.PubKey.Fingerprint(), rotation.Old)
+	assert.Equal(newKey.PubKey.Fingerprint(), rotation.New)
+
+	// The files are not rewritten, only the key file
+	after, err := ioutil.ReadFile(filepath.Join(backend.Root, "file_a"))
+	assert.NoError(err)
+	assert.Equal(before, after)
+	info, err := os.Stat(filepath.Join(backend.Root, "file_a"))
+	if assert.NoError(err) {
+		assert.True(modTime.Equal(info.ModTime()))
+	}
+	files, err := ioutil.ReadDir(filepath.Join(backend.Root, DataKeyDirectory))
+	assert.NoError(err)
+	assert.Len(files, 1, "the temporary key file should be moved")
+
+	newStorage, err := NewHybridEncryptedStorage(backend, []crypt.PublicKey{newKey.PubKey}, &newKey)
+	assert.NoError(err)
+	r, err := newStorage.Download("folder/file_b")
+	if assert.NoError(err) {
+		content, err := ioutil.ReadAll(r)
+		assert.NoError(err)
+		assert.Equal("🍣", string(content))
+		r.Close()
+	}
+	_, err = oldStorage.Download("file_a")
+	assert.Equal(crypt.ErrNotRecipient, errors.Cause(err))
+
+	// Rotated files are skipped the second time, the rotations are recorded.
+	// The encrypted view of the destination, even with encrypted names, finds
+	// the same key files
+	named, err := NewHybridEncryptedStorage(backend, []crypt.PublicKey{newKey.PubKey}, &newKey)
+	assert.NoError(err)
+	assert.NoError(named.EncryptNames([]byte("names key")))
+	rotation, err = RotateKey(named, oldKey, newKey.PubKey)
+	assert.NoError(err)
+	assert.Equal(0, rotation.Keys)
+	assert.Equal(1, rotation.Skipped)
+	metadata, err := ReadKeyMetadata(named)
+	assert.NoError(err)
+	assert.Len(metadata.Rotations, 2)
+	_, err = os.Stat(filepath.Join(backend.Root, KeyMetadataFile))
+	assert.NoError(err)
+
+	// The metadata is not synced away
+	assert.NoError(Sync(src, ".", newStorage, "."))
+	metadata, err = ReadKeyMetadata(backend)
+	assert.NoError(err)
+	assert.Len(metadata.Rotations, 2)
+}
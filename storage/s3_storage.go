@@ -0,0 +1,673 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// s3MetaMtime is the metadata holding the modification time of an object
+	s3MetaMtime = "X-Amz-Meta-Mtime"
+	// defaultS3PartSize is the size of the parts of a multipart upload, S3
+	// needs them to be at least 5MiB
+	defaultS3PartSize = 8 << 20
+	// s3HeadWorkers is the number of objects List reads the metadata of at
+	// the same time
+	s3HeadWorkers = 8
+	s3TimeFormat  = "20060102T150405Z"
+)
+
+// ErrDirectoryNotEmpty is returned when removing a directory that has children
+var ErrDirectoryNotEmpty = errors.New("directory is not empty")
+
+func init() {
+	Register("s3", openS3)
+}
+
+// openS3 returns the storage at an s3://bucket/prefix URL. The credentials
+// are read from the AWS_* environment variables, with AWS_ENDPOINT_URL for
+// the compatible servers
+func openS3(u *url.URL) (Storage, error) {
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+	endpoint := os.Getenv("AWS_ENDPOINT_URL")
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	s, err := NewS3Storage(S3Config{
+		Endpoint:     endpoint,
+		Region:       region,
+		Bucket:       u.Host,
+		Prefix:       u.Path,
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// S3Config is the location of an S3 (or compatible) bucket and the
+// credentials to access it
+type S3Config struct {
+	Endpoint     string // For instance https://s3.eu-west-1.amazonaws.com
+	Region       string
+	Bucket       string
+	Prefix       string // Root of the storage in the bucket
+	AccessKey    string
+	SecretKey    string
+	SessionToken string       // Optional, for temporary credentials
+	PartSize     int          // Size of the parts of the uploads, defaultS3PartSize if 0
+	Client       *http.Client // http.DefaultClient if nil
+}
+
+// S3Storage implements Storage in an S3 bucket. Objects are addressed with
+// the path style (Endpoint/Bucket/key) so it works with the compatible
+// servers too. Directories only exist through the objects in them, or an
+// empty marker object (the directory key followed by /) written by Mkdir.
+// Modification times are stored in the metadata of each object, so listing
+// reads the metadata of each file
+type S3Storage struct {
+	config S3Config
+	prefix string // Prefix of the keys, empty or ending with /
+}
+
+// NewS3Storage returns a storage in the bucket of config. It checks that the
+// bucket can be listed
+func NewS3Storage(config S3Config) (*S3Storage, error) {
+	if config.Bucket == "" || config.Endpoint == "" {
+		return nil, errors.New("s3 storage needs an endpoint and a bucket")
+	}
+	if config.PartSize <= 0 {
+		config.PartSize = defaultS3PartSize
+	}
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+	config.Endpoint = strings.TrimSuffix(config.Endpoint, "/")
+	s := &S3Storage{config: config}
+	if prefix := strings.Trim(config.Prefix, "/"); prefix != "" {
+		s.prefix = prefix + "/"
+	}
+	if _, err := s.listObjects(s.prefix, "/", "", 1); err != nil {
+		return nil, errors.Wrap(err, "failed to list bucket "+config.Bucket)
+	}
+	return s, nil
+}
+
+// s3Error is an error answered by S3
+type s3Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("s3: status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("s3: %s: %s", e.Code, e.Message)
+}
+
+// key returns the key of the object at relative, relative to the prefix
+func (s *S3Storage) key(relative string) (string, error) {
+	p := path.Clean(relative)
+	if p == ".." || strings.HasPrefix(p, "../") || strings.HasPrefix(p, "/") {
+		return "", ErrNotInRoot
+	}
+	if p == "." {
+		return strings.TrimSuffix(s.prefix, "/"), nil
+	}
+	return s.prefix + p, nil
+}
+
+// dirPrefix returns the prefix of the keys in the directory whose key is key
+func (s *S3Storage) dirPrefix(key string) string {
+	if key == "" {
+		return ""
+	}
+	return key + "/"
+}
+
+// s3Escape escapes s as S3 expects in the signed requests: everything but
+// the unreserved characters, and / if keepSlash is set
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && keepSlash) {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+// s3Query encodes query as S3 expects in the signed requests
+func s3Query(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// signS3Request sets the AWS signature (version 4) of req, made at t. The
+// X-Amz-Content-Sha256 header should already be set. The host, the range,
+// the content type and the X-Amz-* headers are signed
+func signS3Request(req *http.Request, region, accessKey, secretKey string, t time.Time) {
+	amzDate := t.UTC().Format(s3TimeFormat)
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{"host": req.Host}
+	if req.Host == "" {
+		headers["host"] = req.URL.Host
+	}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") || name == "range" || name == "content-type" || name == "content-md5" {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		s3Query(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		req.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// do sends a signed request for the object key, the bucket if key is empty.
+// It fails if S3 doesn't answer with a 2xx status, with ErrNotExist as cause
+// for a 404. The body of the answer should be closed otherwise
+func (s *S3Storage) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u, err := url.Parse(s.config.Endpoint + "/" + s3Escape(s.config.Bucket, false) + "/" + s3Escape(key, true))
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = s3Query(query)
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	hash := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(hash[:]))
+	if s.config.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.config.SessionToken)
+	}
+	signS3Request(req, s.config.Region, s.config.AccessKey, s.config.SecretKey, time.Now())
+	resp, err := s.config.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		s3Err := &s3Error{StatusCode: resp.StatusCode}
+		content, _ := ioutil.ReadAll(resp.Body)
+		xml.Unmarshal(content, s3Err)
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, errors.Wrap(ErrNotExist, s3Err.Error())
+		}
+		return nil, s3Err
+	}
+	return resp, nil
+}
+
+// doXML sends a request with do and decodes its XML answer in v. Some
+// requests can fail after a 200 status, with an error in the answer
+func (s *S3Storage) doXML(method, key string, query url.Values, header http.Header, body []byte, v interface{}) error {
+	resp, err := s.do(method, key, query, header, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var root struct{ XMLName xml.Name }
+	if err = xml.Unmarshal(content, &root); err == nil && root.XMLName.Local == "Error" {
+		s3Err := &s3Error{StatusCode: resp.StatusCode}
+		xml.Unmarshal(content, s3Err)
+		return s3Err
+	}
+	if v == nil {
+		return nil
+	}
+	return xml.Unmarshal(content, v)
+}
+
+// s3Listing is the answer of ListObjectsV2
+type s3Listing struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		LastModified time.Time `xml:"LastModified"`
+		Size         int64     `xml:"Size"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// listObjects returns the listing of the keys starting with prefix, grouped
+// by delimiter if it is set. It returns all the pages unless max is set
+func (s *S3Storage) listObjects(prefix, delimiter, token string, max int) (s3Listing, error) {
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	if delimiter != "" {
+		query.Set("delimiter", delimiter)
+	}
+	if max > 0 {
+		query.Set("max-keys", strconv.Itoa(max))
+	}
+	if token != "" {
+		query.Set("continuation-token", token)
+	}
+	var listing s3Listing
+	if err := s.doXML(http.MethodGet, "", query, nil, nil, &listing); err != nil {
+		return listing, err
+	}
+	if max > 0 || !listing.IsTruncated {
+		return listing, nil
+	}
+	next, err := s.listObjects(prefix, delimiter, listing.NextContinuationToken, 0)
+	listing.Contents = append(listing.Contents, next.Contents...)
+	listing.CommonPrefixes = append(listing.CommonPrefixes, next.CommonPrefixes...)
+	return listing, err
+}
+
+// head returns the metadata of the object key
+func (s *S3Storage) head(key string) (http.Header, error) {
+	resp, err := s.do(http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp.Header, nil
+}
+
+// s3ModTime returns the modification time of an object from its metadata, or
+// lastModified if it doesn't have one
+func s3ModTime(header http.Header, lastModified time.Time) time.Time {
+	t, err := time.Parse(time.RFC3339Nano, header.Get(s3MetaMtime))
+	if err != nil {
+		return lastModified
+	}
+	return t
+}
+
+// Download returns an object that can be read
+func (s *S3Storage) Download(relative string) (io.ReadCloser, error) {
+	key, err := s.key(relative)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(http.MethodGet, key, nil, nil, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to download "+relative)
+	}
+	return resp.Body, nil
+}
+
+// listDirectory returns the key prefix of the directory at relative, its
+// directories and its files with the time they were uploaded as Modified
+func (s *S3Storage) listDirectory(relative string) (string, []StoreObject, []StoreObject, error) {
+	key, err := s.key(relative)
+	if err != nil {
+		return "", nil, nil, errors.Wrap(err, "failed to list")
+	}
+	prefix := s.dirPrefix(key)
+	listing, err := s.listObjects(prefix, "/", "", 0)
+	if err != nil {
+		return "", nil, nil, errors.Wrap(err, "failed to list "+relative)
+	}
+	if key != strings.TrimSuffix(s.prefix, "/") && len(listing.Contents) == 0 && len(listing.CommonPrefixes) == 0 {
+		return "", nil, nil, errors.Wrap(ErrNotExist, "failed to list "+relative)
+	}
+
+	nodes := make([]StoreObject, 0, len(listing.Contents)+len(listing.CommonPrefixes))
+	for _, p := range listing.CommonPrefixes {
+		name := strings.TrimSuffix(strings.TrimPrefix(p.Prefix, prefix), "/")
+		nodes = append(nodes, StoreObject{IsDirectory: true, Name: name})
+	}
+	files := make([]StoreObject, 0, len(listing.Contents))
+	for _, c := range listing.Contents {
+		if c.Key == prefix { // Marker of the directory
+			continue
+		}
+		files = append(files, StoreObject{
+			Modified: c.LastModified,
+			Name:     strings.TrimPrefix(c.Key, prefix),
+			Size:     int(c.Size),
+		})
+	}
+	return prefix, nodes, files, nil
+}
+
+// listNames lists the directory at relative without reading the metadata of
+// its files, see nameLister
+func (s *S3Storage) listNames(relative string) ([]StoreObject, error) {
+	_, nodes, files, err := s.listDirectory(relative)
+	if err != nil {
+		return nil, err
+	}
+	return append(nodes, files...), nil
+}
+
+// atomicUploads marks that an object is only visible once fully uploaded
+func (s *S3Storage) atomicUploads() {}
+
+// List returns a list of node in the path
+func (s *S3Storage) List(relative string) ([]StoreObject, error) {
+	prefix, nodes, files, err := s.listDirectory(relative)
+	if err != nil {
+		return nil, err
+	}
+
+	// The modification times are in the metadata of each file
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs MultiError
+	workers := make(chan struct{}, s3HeadWorkers)
+	for i := range files {
+		wg.Add(1)
+		workers <- struct{}{}
+		go func(f *StoreObject) {
+			defer func() {
+				<-workers
+				wg.Done()
+			}()
+			header, err := s.head(prefix + f.Name)
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, errors.Wrap(err, "failed to read metadata of "+f.Name))
+				mu.Unlock()
+				return
+			}
+			f.Modified = s3ModTime(header, f.Modified)
+		}(&files[i])
+	}
+	wg.Wait()
+	if err = errs.errorOrNil(); err != nil {
+		return nil, err
+	}
+	return append(nodes, files...), nil
+}
+
+// Mkdir creates a directory, as an empty marker object
+func (s *S3Storage) Mkdir(relative string) error {
+	key, err := s.key(relative)
+	if err != nil {
+		return err
+	}
+	if key == strings.TrimSuffix(s.prefix, "/") {
+		return nil // The root always exists
+	}
+	resp, err := s.do(http.MethodPut, key+"/", nil, nil, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to create directory "+relative)
+	}
+	return resp.Body.Close()
+}
+
+// isDirectory returns whether key is a directory, ErrNotExist if it is
+// neither a directory nor a file
+func (s *S3Storage) isDirectory(key string) (bool, error) {
+	_, err := s.head(key)
+	if err == nil {
+		return false, nil
+	}
+	if errors.Cause(err) != ErrNotExist {
+		return false, err
+	}
+	listing, err := s.listObjects(key+"/", "", "", 1)
+	if err != nil {
+		return false, err
+	}
+	if len(listing.Contents) == 0 {
+		return false, ErrNotExist
+	}
+	return true, nil
+}
+
+// Move moves a file to a new location, this can only move files and not
+// folders. The object is copied then removed, it only works for files
+// smaller than 5GB
+func (s *S3Storage) Move(src, dst string) error {
+	srcKey, err := s.key(src)
+	if err != nil {
+		return err
+	}
+	dstKey, err := s.key(dst)
+	if err != nil {
+		return err
+	}
+	dir, err := s.isDirectory(srcKey)
+	if err != nil {
+		return err
+	}
+	if dir {
+		return ErrDirectory
+	}
+	header := http.Header{
+		"X-Amz-Copy-Source":        {"/" + s3Escape(s.config.Bucket, false) + "/" + s3Escape(srcKey, true)},
+		"X-Amz-Metadata-Directive": {"COPY"},
+	}
+	if err = s.doXML(http.MethodPut, dstKey, nil, header, nil, nil); err != nil {
+		return errors.Wrap(err, "failed to copy "+src+" to "+dst)
+	}
+	resp, err := s.do(http.MethodDelete, srcKey, nil, nil, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to remove "+src)
+	}
+	return resp.Body.Close()
+}
+
+// Remove a path (file or empty directory)
+func (s *S3Storage) Remove(relative string) error {
+	key, err := s.key(relative)
+	if err != nil {
+		return err
+	}
+	dir, err := s.isDirectory(key)
+	if err != nil {
+		return err
+	}
+	if dir {
+		listing, err := s.listObjects(key+"/", "", "", 2)
+		if err != nil {
+			return err
+		}
+		for _, c := range listing.Contents {
+			if c.Key != key+"/" {
+				return errors.Wrap(ErrDirectoryNotEmpty, relative)
+			}
+		}
+		key += "/"
+	}
+	resp, err := s.do(http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to remove "+relative)
+	}
+	return resp.Body.Close()
+}
+
+// s3Writer uploads an object, in a single request if it is smaller than a
+// part or as a multipart upload
+type s3Writer struct {
+	s        *S3Storage
+	key      string
+	metadata http.Header
+	buf      bytes.Buffer
+	uploadID string
+	parts    []s3Part
+	err      error
+	closed   bool
+}
+
+// s3Part is an uploaded part of a multipart upload
+type s3Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.buf.Write(p)
+	if w.buf.Len() >= w.s.config.PartSize {
+		w.err = w.uploadPart()
+	}
+	return len(p), w.err
+}
+
+// uploadPart uploads the buffer as the next part, starting the multipart
+// upload with the first one
+func (w *s3Writer) uploadPart() error {
+	if w.uploadID == "" {
+		var initiated struct {
+			UploadID string `xml:"UploadId"`
+		}
+		err := w.s.doXML(http.MethodPost, w.key, url.Values{"uploads": {""}}, w.metadata, nil, &initiated)
+		if err != nil {
+			return errors.Wrap(err, "failed to start upload of "+w.key)
+		}
+		w.uploadID = initiated.UploadID
+	}
+	number := len(w.parts) + 1
+	query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {w.uploadID}}
+	resp, err := w.s.do(http.MethodPut, w.key, query, nil, w.buf.Bytes())
+	if err != nil {
+		return errors.Wrap(err, "failed to upload part of "+w.key)
+	}
+	resp.Body.Close()
+	w.parts = append(w.parts, s3Part{PartNumber: number, ETag: resp.Header.Get("ETag")})
+	w.buf.Reset()
+	return nil
+}
+
+// abort cancels the multipart upload, if any, after err
+func (w *s3Writer) abort(err error) error {
+	if w.uploadID != "" {
+		resp, abortErr := w.s.do(http.MethodDelete, w.key, url.Values{"uploadId": {w.uploadID}}, nil, nil)
+		if abortErr == nil {
+			resp.Body.Close()
+		}
+	}
+	return err
+}
+
+func (w *s3Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if w.err != nil {
+		return w.abort(w.err)
+	}
+	if w.uploadID == "" {
+		resp, err := w.s.do(http.MethodPut, w.key, nil, w.metadata, w.buf.Bytes())
+		if err != nil {
+			return errors.Wrap(err, "failed to upload "+w.key)
+		}
+		return resp.Body.Close()
+	}
+	if w.buf.Len() > 0 {
+		if err := w.uploadPart(); err != nil {
+			return w.abort(err)
+		}
+	}
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: w.parts})
+	if err != nil {
+		return w.abort(err)
+	}
+	err = w.s.doXML(http.MethodPost, w.key, url.Values{"uploadId": {w.uploadID}}, nil, body, nil)
+	if err != nil {
+		return w.abort(errors.Wrap(err, "failed to complete upload of "+w.key))
+	}
+	return nil
+}
+
+// Upload returns an object that can be written to. It will create the
+// file if it doesn't already exist. If it exists, it will overrides it.
+// The object is only written on Close
+func (s *S3Storage) Upload(relative string, modTime time.Time) (io.WriteCloser, error) {
+	key, err := s.key(relative)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Writer{
+		s:        s,
+		key:      key,
+		metadata: http.Header{s3MetaMtime: {modTime.UTC().Format(time.RFC3339Nano)}},
+	}, nil
+}
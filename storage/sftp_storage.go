@@ -0,0 +1,288 @@
+package storage
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/pkg/sftp"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sftpPasswordEnv is the environment variable holding the SSH password
+const sftpPasswordEnv = "TRI_SFTP_PASSWORD"
+
+// sshKeys are the private keys, in ~/.ssh, tried to log in
+var sshKeys = []string{"id_ed25519", "id_ecdsa", "id_rsa"}
+
+// openSFTP returns the storage at an sftp://[user@]host[:port]/path URL. The
+// path is absolute, or relative to the login directory if it starts with /~/.
+// It logs in with the ssh-agent, the unencrypted keys of ~/.ssh or the
+// password in $TRI_SFTP_PASSWORD, and checks the host in ~/.ssh/known_hosts
+func openSFTP(u *url.URL) (Storage, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	hostKeys, err := knownhosts.New(filepath.Join(home, ".ssh", "known_hosts"))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read known hosts")
+	}
+	user := u.User.Username()
+	if user == "" {
+		user = os.Getenv("USER")
+	}
+	config := &ssh.ClientConfig{
+		User:            user,
+		Auth:            sshAuth(home),
+		HostKeyCallback: hostKeys,
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "22")
+	}
+	root := u.Path
+	if strings.HasPrefix(root, "/~/") || root == "/~" {
+		root = strings.TrimPrefix(strings.TrimPrefix(root, "/~"), "/")
+	}
+	s, err := DialSFTP(addr, config, root)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// sshAuth returns the methods available to log in
+func sshAuth(home string) []ssh.AuthMethod {
+	var methods []ssh.AuthMethod
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			log.Infof("Not using the ssh-agent: %s", err)
+		} else {
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+	var signers []ssh.Signer
+	for _, name := range sshKeys {
+		data, err := ioutil.ReadFile(filepath.Join(home, ".ssh", name))
+		if err != nil {
+			continue
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			log.Infof("Not using the key %s: %s", name, err)
+			continue
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+	if password := os.Getenv(sftpPasswordEnv); password != "" {
+		methods = append(methods, ssh.Password(password))
+	}
+	return methods
+}
+
+func init() {
+	Register("sftp", openSFTP)
+}
+
+// SFTPStorage implements Storage in a directory of a server reachable over
+// SSH, with SFTP. Modification times are only kept to the second
+type SFTPStorage struct {
+	Root   string // Root is an absolute path on the server
+	client *sftp.Client
+	conn   *ssh.Client
+}
+
+// DialSFTP connects to the SSH server at addr (host:port) and returns the
+// storage at root on it, see NewSFTPStorage
+func DialSFTP(addr string, config *ssh.ClientConfig, root string) (*SFTPStorage, error) {
+	conn, err := ssh.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to "+addr)
+	}
+	s, err := NewSFTPStorage(conn, root)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewSFTPStorage returns a storage at root on the server of conn, root being
+// relative to the login directory unless it is absolute. It will check if
+// the directory is writable. The storage owns conn, see Close
+func NewSFTPStorage(conn *ssh.Client, root string) (*SFTPStorage, error) {
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to start sftp")
+	}
+	if !path.IsAbs(root) {
+		wd, err := client.Getwd()
+		if err != nil {
+			client.Close()
+			return nil, errors.Wrap(err, "failed to get login directory")
+		}
+		root = path.Join(wd, root)
+	}
+	s := &SFTPStorage{Root: path.Clean(root), client: client, conn: conn}
+
+	// Try to write temp file at root
+	tempPath := path.Join(s.Root, "temp_"+time.Now().Format("150405.000000000"))
+	f, err := client.Create(tempPath)
+	if err == nil {
+		_, err = f.Write([]byte("hello"))
+		err2 := f.Close()
+		if err == nil {
+			err = err2
+		}
+		client.Remove(tempPath)
+	}
+	if err != nil {
+		client.Close()
+		return nil, errors.Wrap(err, "permissions error")
+	}
+	return s, nil
+}
+
+// Close closes the connection to the server
+func (s *SFTPStorage) Close() error {
+	err := s.client.Close()
+	err2 := s.conn.Close()
+	if err == nil {
+		err = err2
+	}
+	return err
+}
+
+// abs returns the path on the server of relative, or ErrNotInRoot
+func (s *SFTPStorage) abs(relative string) (string, error) {
+	abs := path.Join(s.Root, relative)
+	if abs != s.Root && !strings.HasPrefix(abs, s.Root+"/") && s.Root != "/" {
+		return "", ErrNotInRoot
+	}
+	return abs, nil
+}
+
+// Download returns an object that can be read
+func (s *SFTPStorage) Download(relative string) (io.ReadCloser, error) {
+	abs, err := s.abs(relative)
+	if err != nil {
+		return nil, err
+	}
+	return s.client.Open(abs)
+}
+
+// List returns a list of node in the path
+func (s *SFTPStorage) List(relative string) ([]StoreObject, error) {
+	abs, err := s.abs(relative)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list")
+	}
+	listing, err := s.client.ReadDir(abs)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read")
+	}
+	nodes := make([]StoreObject, len(listing))
+	for i, l := range listing {
+		nodes[i] = StoreObject{
+			IsDirectory: l.IsDir(),
+			Modified:    l.ModTime(),
+			Name:        l.Name(),
+			Size:        int(l.Size()),
+		}
+	}
+	return nodes, nil
+}
+
+// Mkdir creates a directory and potentially parents
+func (s *SFTPStorage) Mkdir(relative string) error {
+	abs, err := s.abs(relative)
+	if err != nil {
+		return err
+	}
+	return s.client.MkdirAll(abs)
+}
+
+// Move moves a file to a new location, this can only move files and not
+// folders. An existing file at dst is replaced
+func (s *SFTPStorage) Move(src, dst string) error {
+	srcAbs, err := s.abs(src)
+	if err != nil {
+		return err
+	}
+	dstAbs, err := s.abs(dst)
+	if err != nil {
+		return err
+	}
+	info, err := s.client.Stat(srcAbs)
+	if err != nil {
+		return ErrNotExist
+	}
+	if info.IsDir() {
+		return ErrDirectory
+	}
+	return s.client.PosixRename(srcAbs, dstAbs)
+}
+
+// Remove a path (file or empty directory)
+func (s *SFTPStorage) Remove(relative string) error {
+	abs, err := s.abs(relative)
+	if err != nil {
+		return err
+	}
+	return s.client.Remove(abs)
+}
+
+// sftpFileWithModTimeCloser sets the modification time of a file on the
+// server once it is written, like fileWithModTimeCloser
+type sftpFileWithModTimeCloser struct {
+	*sftp.File
+	client  *sftp.Client
+	closed  bool
+	modTime time.Time
+}
+
+func (f *sftpFileWithModTimeCloser) Close() error {
+	if f.closed { // Already closed
+		return nil
+	}
+	f.closed = true
+	err := f.File.Close()
+	err2 := f.client.Chtimes(f.Name(), time.Now(), f.modTime)
+	if err != nil {
+		return err
+	}
+	return err2
+}
+
+// Upload returns an object that can be written to. It will create the
+// file if it doesn't already exist. If it exists, it will overrides it
+func (s *SFTPStorage) Upload(relative string, modTime time.Time) (io.WriteCloser, error) {
+	abs, err := s.abs(relative)
+	if err != nil {
+		return nil, err
+	}
+	f, err := s.client.OpenFile(abs, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return nil, err
+	}
+	return &sftpFileWithModTimeCloser{
+		File:    f,
+		client:  s.client,
+		modTime: modTime,
+	}, nil
+}
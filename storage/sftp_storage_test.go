@@ -0,0 +1,151 @@
+package storage
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// serveSFTP starts an in-process SSH server, with the password "secret",
+// serving SFTP on the local file system. It returns its address with the
+// client configuration to connect to it
+func serveSFTP(t *testing.T) (string, *ssh.ClientConfig, func()) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate host key: %s", err)
+	}
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatalf("Failed to generate host key: %s", err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if c.User() == "tri" && string(password) == "secret" {
+				return nil, nil
+			}
+			return nil, ErrNotInRoot
+		},
+	}
+	config.AddHostKey(signer)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSFTPConn(conn, config)
+		}
+	}()
+
+	clientConfig := &ssh.ClientConfig{
+		User:            "tri",
+		Auth:            []ssh.AuthMethod{ssh.Password("secret")},
+		HostKeyCallback: ssh.FixedHostKey(signer.PublicKey()),
+	}
+	return listener.Addr().String(), clientConfig, func() { listener.Close() }
+}
+
+func serveSFTPConn(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func(in <-chan *ssh.Request) {
+			for req := range in {
+				req.Reply(req.Type == "subsystem" && string(req.Payload[4:]) == "sftp", nil)
+			}
+		}(requests)
+		server, err := sftp.NewServer(channel)
+		if err != nil {
+			channel.Close()
+			continue
+		}
+		go func() {
+			server.Serve()
+			server.Close()
+		}()
+	}
+}
+
+func TestSFTPStorage(t *testing.T) {
+	assert := assert.New(t)
+	addr, config, stop := serveSFTP(t)
+	defer stop()
+	local, cleanupTestPath, err := getLocalStorageAndCleanup()
+	if !assert.NoError(err, "failed to get storage") {
+		t.FailNow()
+	}
+	root := local.(*LocalStorage).Root
+	defer os.RemoveAll(root)
+
+	s, err := DialSFTP(addr, config, root)
+	if !assert.NoError(err) {
+		t.FailNow()
+	}
+	defer s.Close()
+	t.Run("SFTPStorage", RunStorageTests(NewStorageTester(s, cleanupTestPath)))
+
+	wrong := *config
+	wrong.Auth = []ssh.AuthMethod{ssh.Password("wrong")}
+	_, err = DialSFTP(addr, &wrong, root)
+	assert.Error(err, "the password should be checked")
+}
+
+func TestSFTPStorageSync(t *testing.T) {
+	assert := assert.New(t)
+	addr, config, stop := serveSFTP(t)
+	defer stop()
+	src, cleanupSrc := newTempLocalStorage(t)
+	defer cleanupSrc()
+	dst, cleanupDst := newTempLocalStorage(t)
+	defer cleanupDst()
+	writeFile(t, src.Root, "folder/file_a", "a")
+	writeFile(t, src.Root, "folder/file_b", "b")
+	writeFile(t, src.Root, "file_c", "")
+	modTime := time.Date(2020, time.May, 17, 20, 10, 6, 123456789, time.UTC)
+	assert.NoError(os.Chtimes(filepath.Join(src.Root, "folder", "file_a"), modTime, modTime))
+
+	s, err := DialSFTP(addr, config, dst.Root)
+	if !assert.NoError(err) {
+		t.FailNow()
+	}
+	defer s.Close()
+	assert.NoError(SyncWithOptions(src, ".", s, ".", SyncOptions{Transfers: 4}))
+	assert.Equal("a", readFile(t, dst.Root, "folder/file_a"))
+	info, err := os.Stat(filepath.Join(dst.Root, "folder", "file_a"))
+	if assert.NoError(err) {
+		assert.True(modTime.Truncate(time.Second).Equal(info.ModTime()), "the modification time should be kept to the second")
+	}
+
+	// Only the seconds are kept but nothing is copied again
+	assert.NoError(Sync(src, ".", s, "."))
+	bin, err := ioutil.ReadDir(filepath.Join(dst.Root, BinDirectory))
+	if !os.IsNotExist(err) && assert.NoError(err) {
+		assert.Empty(bin, "nothing should have been replaced")
+	}
+	_, err = DialSFTP(addr, config, filepath.Join(dst.Root, "missing"))
+	assert.Error(err)
+}
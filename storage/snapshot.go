@@ -0,0 +1,286 @@
+package storage
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// SnapshotDirectory is the directory, at the root of a destination, where
+	// Sync saves a snapshot manifest at the end of each run that changed it
+	SnapshotDirectory = ".tri-snapshots"
+	snapshotExt       = ".json"
+)
+
+// ErrSnapshotMismatch is returned when restoring a file whose content is not
+// the one recorded in the snapshot
+var ErrSnapshotMismatch = errors.New("content doesn't match the snapshot")
+
+// Snapshot is the manifest of the state of a destination after a sync. Its
+// ID is the name of the bin generation of the same sync
+type Snapshot struct {
+	ID   string    `json:"id"`
+	Time time.Time `json:"time"`
+	Tree SyncNode  `json:"tree"` // Files have their Hash set
+}
+
+// snapshotPath returns the path of the manifest of the snapshot id
+func snapshotPath(root, id string) string {
+	return root + "/" + SnapshotDirectory + "/" + id + snapshotExt
+}
+
+// Snapshots returns the IDs of the snapshots of the destination at root in
+// s, oldest first
+func Snapshots(s ReadableStorage, root string) ([]string, error) {
+	listing, err := s.List(root)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list "+root)
+	}
+	if _, ok := findObject(listing, SnapshotDirectory); !ok {
+		return nil, nil // Never synced
+	}
+	listing, err = s.List(root + "/" + SnapshotDirectory)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list snapshots")
+	}
+	ids := make([]string, 0, len(listing))
+	for _, l := range listing {
+		id := strings.TrimSuffix(l.Name, snapshotExt)
+		if _, err := time.Parse(binTimeFormat, id); err != nil || l.IsDirectory || id == l.Name {
+			continue // Not created by Sync
+		}
+		ids = append(ids, id)
+	}
+	sort.Strings(ids) // The format sorts chronologically
+	return ids, nil
+}
+
+// ReadSnapshot returns the snapshot id of the destination at root in s
+func ReadSnapshot(s ReadableStorage, root, id string) (Snapshot, error) {
+	var snapshot Snapshot
+	r, err := s.Download(snapshotPath(root, id))
+	if err != nil {
+		return snapshot, errors.Wrap(err, "failed to open snapshot "+id)
+	}
+	defer r.Close()
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return snapshot, errors.Wrap(err, "failed to read snapshot "+id)
+	}
+	err = json.Unmarshal(content, &snapshot)
+	return snapshot, errors.Wrap(err, "failed to parse snapshot "+id)
+}
+
+// writeSnapshot writes the manifest of snapshot in the destination at root in s
+func writeSnapshot(s Storage, root string, snapshot Snapshot) error {
+	content, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	err = s.Mkdir(root + "/" + SnapshotDirectory)
+	if err != nil {
+		return errors.Wrap(err, "failed to create snapshot directory")
+	}
+	p := snapshotPath(root, snapshot.ID)
+	w, err := s.Upload(p, snapshot.Time)
+	if err != nil {
+		return errors.Wrap(err, "failed to open "+p)
+	}
+	_, err = w.Write(content)
+	err2 := w.Close()
+	if err == nil {
+		err = err2
+	}
+	return errors.Wrap(err, "failed to write snapshot "+snapshot.ID)
+}
+
+// lookupNode returns the node at the relative path in n
+func lookupNode(n SyncNode, relative string) (SyncNode, bool) {
+	if relative == "" {
+		return n, true
+	}
+	for _, name := range strings.Split(relative, "/") {
+		found := false
+		for _, c := range n.Children {
+			if c.Name == name {
+				n, found = c, true
+				break
+			}
+		}
+		if !found {
+			return SyncNode{}, false
+		}
+	}
+	return n, true
+}
+
+// sameContent returns whether the files a and b are the same version
+func sameContent(a, b StoreObject) bool {
+	return !a.IsDirectory && !b.IsDirectory && a.Size == b.Size && sameTime(a.Modified, b.Modified)
+}
+
+// latestSnapshot returns the tree of the latest snapshot of the destination
+// at root in s, and whether there is one. The tree is empty if there is none
+// or if it can't be read because the destination is written with public
+// keys only
+func latestSnapshot(s ReadableStorage, root string) (SyncNode, bool, error) {
+	ids, err := Snapshots(s, root)
+	if err != nil || len(ids) == 0 {
+		return SyncNode{}, false, err
+	}
+	snapshot, err := ReadSnapshot(s, root, ids[len(ids)-1])
+	if errors.Cause(err) == ErrNoPrivateKey {
+		log.Infof("Can't read snapshot %s without private key", ids[len(ids)-1])
+		return SyncNode{}, true, nil
+	}
+	return snapshot.Tree, true, err
+}
+
+// pruneSnapshots removes the manifests of the snapshots of the destination at
+// root in s older than the bin generation purged. Their files replaced since
+// were moved to the bin by the following syncs, so some may have been purged
+func pruneSnapshots(s Storage, root, purged string) error {
+	ids, err := Snapshots(s, root)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if id >= purged { // The format sorts chronologically
+			break
+		}
+		log.Infof("Removing snapshot %s, it needs bin generation %s", id, purged)
+		if err = s.Remove(snapshotPath(root, id)); err != nil {
+			return errors.Wrap(err, "failed to remove snapshot "+id)
+		}
+	}
+	return nil
+}
+
+// fillHashes returns tree, at root in s, with the Hash of all its files set.
+// The ones that are not set by the backend are taken from known (a snapshot
+// of the same files) if they didn't change, or computed. With
+// continueOnError, the files that can't be read are left without Hash and
+// their errors (FileErrors) are returned with the tree
+func fillHashes(s ReadableStorage, root string, tree, known SyncNode, continueOnError bool) (SyncNode, error) {
+	var errs MultiError
+	var walk func(n SyncNode, relative string) (SyncNode, error)
+	walk = func(n SyncNode, relative string) (SyncNode, error) {
+		if !n.IsDirectory {
+			if n.Hash != "" {
+				return n, nil
+			}
+			if k, ok := lookupNode(known, relative); ok && k.Hash != "" && sameContent(k.StoreObject, n.StoreObject) {
+				n.Hash = k.Hash
+				return n, nil
+			}
+			p := root + "/" + relative
+			hash, err := FileHash(s, p)
+			if err != nil && continueOnError {
+				errs = append(errs, &FileError{Path: p, Err: err})
+				return n, nil
+			}
+			n.Hash = hash
+			return n, err
+		}
+		children := make([]SyncNode, len(n.Children))
+		for i, c := range n.Children {
+			child, err := walk(c, path.Join(relative, c.Name))
+			if err != nil {
+				return SyncNode{}, err
+			}
+			children[i] = child
+		}
+		n.Children = children
+		return n, nil
+	}
+	tree, err := walk(tree, "")
+	if err != nil {
+		return SyncNode{}, err
+	}
+	return tree, errs.errorOrNil()
+}
+
+// setHashes returns n, at the relative path, with the Hash of the files in
+// hashes (by relative path) set
+func setHashes(n SyncNode, relative string, hashes map[string]string) SyncNode {
+	if !n.IsDirectory {
+		if hash, ok := hashes[relative]; ok {
+			n.Hash = hash
+		}
+		return n
+	}
+	children := make([]SyncNode, len(n.Children))
+	for i, c := range n.Children {
+		children[i] = setHashes(c, path.Join(relative, c.Name), hashes)
+	}
+	n.Children = children
+	return n
+}
+
+// snapshotSources returns, for each file of snapshot, the path in s of its
+// content: in the destination at root when it didn't change since, or in
+// one of the generations of the bin. It fails if a file was purged
+func snapshotSources(s Storage, root string, snapshot Snapshot) (map[string]string, error) {
+	mirror, err := GetTree(s, StoreObject{IsDirectory: true}, root)
+	if err != nil {
+		return nil, err
+	}
+	mirror = withoutReserved(mirror)
+	bin := NewBin(s, root)
+	generations, err := bin.Generations()
+	if err != nil {
+		return nil, err
+	}
+	binTrees := make([]SyncNode, len(generations))
+	for i, g := range generations {
+		binTrees[i], err = bin.List(g.Name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// found returns whether the candidate at p is the version of n
+	found := func(p string, candidate, n SyncNode) bool {
+		if sameContent(candidate.StoreObject, n.StoreObject) {
+			return true
+		}
+		// Files synced with Checksum can have another modification time
+		if candidate.IsDirectory || candidate.Size != n.Size || n.Hash == "" {
+			return false
+		}
+		hash, err := FileHash(s, p)
+		return err == nil && hash == n.Hash
+	}
+	sources := make(map[string]string)
+	var walk func(n SyncNode, relative string) error
+	walk = func(n SyncNode, relative string) error {
+		if n.IsDirectory {
+			for _, c := range n.Children {
+				if err := walk(c, path.Join(relative, c.Name)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if m, ok := lookupNode(mirror, relative); ok && found(root+"/"+relative, m, n) {
+			sources[relative] = root + "/" + relative
+			return nil
+		}
+		for i, g := range generations {
+			p := bin.path() + "/" + g.Name + "/" + relative
+			if b, ok := lookupNode(binTrees[i], relative); ok && found(p, b, n) {
+				sources[relative] = p
+				return nil
+			}
+		}
+		return errors.Wrap(ErrNotExist, relative+" is no longer in the bin")
+	}
+	return sources, walk(snapshot.Tree, "")
+}
@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshots(t *testing.T) {
+	assert := assert.New(t)
+	src, cleanupSrc := newTempLocalStorage(t)
+	defer cleanupSrc()
+	dst, cleanupDst := newTempLocalStorage(t)
+	defer cleanupDst()
+	target, cleanupTarget := newTempLocalStorage(t)
+	defer cleanupTarget()
+	defer func() { now = time.Now }()
+	syncAt := func(minute int) {
+		now = func() time.Time { return time.Date(2017, time.May, 17, 20, minute, 0, 0, time.UTC) }
+		if !assert.NoError(Sync(src, ".", dst, ".")) {
+			t.FailNow()
+		}
+	}
+	setModified := func(p string, minute int) {
+		modTime := time.Date(2017, time.May, 17, 19, minute, 0, 0, time.UTC)
+		assert.NoError(os.Chtimes(filepath.Join(src.Root, filepath.FromSlash(p)), modTime, modTime))
+	}
+
+	ids, err := Snapshots(dst, ".")
+	assert.NoError(err)
+	assert.Empty(ids)
+
+	writeFile(t, src.Root, "file_a", "a1")
+	writeFile(t, src.Root, "folder/file_b", "b")
+	setModified("file_a", 1)
+	setModified("folder/file_b", 1)
+	syncAt(1)
+	writeFile(t, src.Root, "file_a", "a2")
+	setModified("file_a", 2)
+	syncAt(2)
+	assert.NoError(os.Remove(filepath.Join(src.Root, "folder/file_b")))
+	syncAt(3)
+
+	ids, err = Snapshots(dst, ".")
+	assert.NoError(err)
+	assert.Equal([]string{"20170517-200100", "20170517-200200", "20170517-200300"}, ids)
+	snapshot, err := ReadSnapshot(dst, ".", ids[0])
+	assert.NoError(err)
+	assert.Equal(ids[0], snapshot.ID)
+	node, ok := lookupNode(snapshot.Tree, "folder/file_b")
+	if assert.True(ok) {
+		assert.Equal(1, node.Size)
+		// sha256 of "b"
+		assert.Equal("3e23e8160039594a33894f6564e1b1348bbd7a0088d42c4acb73eeaed59c009d", node.Hash)
+	}
+	snapshot, err = ReadSnapshot(dst, ".", ids[2])
+	assert.NoError(err)
+	_, ok = lookupNode(snapshot.Tree, "folder/file_b")
+	assert.False(ok)
+
+	// Each snapshot can be restored, from the mirror and the bin
+	for i, expected := range []map[string]string{
+		{"file_a": "a1", "folder/file_b": "b"},
+		{"file_a": "a2", "folder/file_b": "b"},
+		{"file_a": "a2", "folder/file_b": ""},
+	} {
+		_, err = Restore(dst, ".", target, ids[i], RestoreOptions{Snapshot: ids[i]})
+		assert.NoError(err)
+		for p, content := range expected {
+			assert.Equal(content, readFile(t, target.Root, ids[i]+"/"+p), "%s in %s", p, ids[i])
+		}
+	}
+	info, err := os.Stat(filepath.Join(target.Root, ids[0], "file_a"))
+	if assert.NoError(err) {
+		assert.True(time.Date(2017, time.May, 17, 19, 1, 0, 0, time.UTC).Equal(info.ModTime()))
+	}
+
+	// The content has to match the snapshot
+	mirrorModified := time.Date(2017, time.May, 17, 19, 2, 0, 0, time.UTC)
+	writeFile(t, dst.Root, "file_a", "a3")
+	assert.NoError(os.Chtimes(filepath.Join(dst.Root, "file_a"), mirrorModified, mirrorModified))
+	_, err = Restore(dst, ".", target, "tampered", RestoreOptions{Snapshot: ids[2]})
+	assert.Equal(ErrSnapshotMismatch, errors.Cause(err))
+	writeFile(t, dst.Root, "file_a", "a2")
+	assert.NoError(os.Chtimes(filepath.Join(dst.Root, "file_a"), mirrorModified, mirrorModified))
+
+	// Purging the bin removes the snapshots that needed it
+	assert.NoError(NewBin(dst, ".").Purge("20170517-200200"))
+	ids, err = Snapshots(dst, ".")
+	assert.NoError(err)
+	assert.Equal([]string{"20170517-200200", "20170517-200300"}, ids)
+	_, err = Restore(dst, ".", target, "purged", RestoreOptions{Snapshot: "20170517-200100"})
+	assert.Error(err)
+	_, err = Restore(dst, ".", target, "kept", RestoreOptions{Snapshot: ids[0]})
+	assert.NoError(err)
+	assert.Equal("a2", readFile(t, target.Root, "kept/file_a"))
+	assert.Equal("b", readFile(t, target.Root, "kept/folder/file_b"))
+
+	// Nothing changed: no new snapshot
+	syncAt(4)
+	ids, err = Snapshots(dst, ".")
+	assert.NoError(err)
+	assert.Equal([]string{"20170517-200200", "20170517-200300"}, ids)
+	_, err = Restore(dst, ".", target, "unknown", RestoreOptions{Snapshot: "20170517-000000"})
+	assert.Error(err)
+}
+
+func TestSnapshotsSameSecond(t *testing.T) {
+	assert := assert.New(t)
+	src, cleanupSrc := newTempLocalStorage(t)
+	defer cleanupSrc()
+	cacheDir, err := ioutil.TempDir("", "tri-index")
+	if !assert.NoError(err) {
+		t.FailNow()
+	}
+	defer os.RemoveAll(cacheDir)
+	defer func() { now = time.Now }()
+	now = func() time.Time { return time.Date(2017, time.May, 17, 20, 1, 0, 0, time.UTC) }
+
+	// Each sync gets its own generation, even in the same second, with or
+	// without the index
+	for _, withIndex := range []bool{false, true} {
+		dst, cleanupDst := newTempLocalStorage(t)
+		defer cleanupDst()
+		var opts SyncOptions
+		if withIndex {
+			opts.Index = OpenIndex(cacheDir, dst.Root)
+		}
+		for _, content := range []string{"a1", "a22", "a333"} {
+			writeFile(t, src.Root, "file_a", content)
+			assert.NoError(SyncWithOptions(src, ".", dst, ".", opts))
+		}
+		ids, err := Snapshots(dst, ".")
+		assert.NoError(err)
+		assert.Equal([]string{"20170517-200100", "20170517-200101", "20170517-200102"}, ids)
+		assert.Equal("a1", readFile(t, dst.Root, BinDirectory+"/20170517-200101/file_a"))
+		assert.Equal("a22", readFile(t, dst.Root, BinDirectory+"/20170517-200102/file_a"))
+	}
+}
@@ -1,16 +1,24 @@
 package storage
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"io"
+	"strings"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
-// StoreObject defines an object in the storage. Name is relative to current path
+// StoreObject defines an object in the storage. Name is relative to current path.
+// Hash is the hex encoded SHA256 of the content, it is optional and empty when unknown
 type StoreObject struct {
-	IsDirectory bool
-	Modified    time.Time
-	Name        string
-	Size        int
+	IsDirectory bool      `json:"dir,omitempty"`
+	Modified    time.Time `json:"modified"`
+	Name        string    `json:"name"`
+	Size        int       `json:"size,omitempty"`
+	Hash        string    `json:"hash,omitempty"`
 }
 
 // IsZero returns whether StoreObject is an empty object
@@ -28,7 +36,7 @@ func (s StoreObject) Equal(other StoreObject) bool {
 	if s.IsDirectory != other.IsDirectory {
 		return false
 	}
-	if !s.Modified.IsZero() && !other.Modified.IsZero() && s.Modified != other.Modified {
+	if !s.Modified.IsZero() && !other.Modified.IsZero() && !sameTime(s.Modified, other.Modified) {
 		return false
 	}
 	if s.Size != 0 && other.Size != 0 && s.Size != other.Size {
@@ -37,17 +45,172 @@ func (s StoreObject) Equal(other StoreObject) bool {
 	return s.Name == other.Name
 }
 
+// sameTime returns whether a and b are the same modification time. When one
+// of them has no fraction of second, as kept by storages like SFTPStorage,
+// only the seconds are compared
+func sameTime(a, b time.Time) bool {
+	if a.Equal(b) {
+		return true
+	}
+	if a.Nanosecond() != 0 && b.Nanosecond() != 0 {
+		return false
+	}
+	return a.Truncate(time.Second).Equal(b.Truncate(time.Second))
+}
+
+// EqualContent tests the equality of 2 store objects based on their
+// content: hashes are compared instead of the modification times. It is
+// Equal if one of the hashes is unknown
+func (s StoreObject) EqualContent(other StoreObject) bool {
+	if s.Hash == "" || other.Hash == "" {
+		return s.Equal(other)
+	}
+	if s.IsDirectory != other.IsDirectory {
+		return false
+	}
+	if s.Size != 0 && other.Size != 0 && s.Size != other.Size {
+		return false
+	}
+	return s.Hash == other.Hash && s.Name == other.Name
+}
+
+// FileHash computes the Hash (see StoreObject) of the file at p in s, for
+// the backends that don't give it when listing
+func FileHash(s ReadableStorage, p string) (string, error) {
+	r, err := s.Download(p)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to open "+p)
+	}
+	defer r.Close()
+	hash := sha256.New()
+	if _, err = io.Copy(hash, r); err != nil {
+		return "", errors.Wrap(err, "failed to read "+p)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// MultiError is returned by the operations done concurrently (see GetTree)
+// when several of them failed
+type MultiError []error
+
+func (e MultiError) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return fmt.Sprintf("%d errors: %s", len(e), strings.Join(messages, "; "))
+}
+
+// errorOrNil returns nil if e is empty, its only error or e
+func (e MultiError) errorOrNil() error {
+	switch len(e) {
+	case 0:
+		return nil
+	case 1:
+		return e[0]
+	}
+	return e
+}
+
+// FileError is the failure of an operation on the file or directory at Path
+// in its storage
+type FileError struct {
+	Path string
+	Err  error
+}
+
+func (e *FileError) Error() string {
+	return e.Err.Error()
+}
+
+// Cause returns the underlying error, see errors.Cause
+func (e *FileError) Cause() error {
+	return e.Err
+}
+
+// asFileErrors returns the FileErrors err is made of, if it only has some
+func asFileErrors(err error) ([]*FileError, bool) {
+	for {
+		switch e := err.(type) {
+		case *FileError:
+			return []*FileError{e}, true
+		case MultiError:
+			var files []*FileError
+			for _, err := range e {
+				f, ok := asFileErrors(err)
+				if !ok {
+					return nil, false
+				}
+				files = append(files, f...)
+			}
+			return files, true
+		case interface{ Cause() error }:
+			err = e.Cause()
+		default:
+			return nil, false
+		}
+	}
+}
+
 type sortAlphabetical []StoreObject
 
 func (n sortAlphabetical) Len() int           { return len(n) }
 func (n sortAlphabetical) Less(i, j int) bool { return n[i].Name < n[j].Name }
 func (n sortAlphabetical) Swap(i, j int)      { n[i], n[j] = n[j], n[i] }
 
+// ReadableStorage defines the methods needed to read a storage, it is all a
+// source needs so sources can be read-only
+type ReadableStorage interface {
+	Download(path string) (io.ReadCloser, error)
+	List(path string) ([]StoreObject, error)
+}
+
+// nameLister is implemented by the storages that need more requests to list
+// the modification times of the files than their names and sizes
+type nameLister interface {
+	// listNames is List, the files may have another Modified time
+	listNames(path string) ([]StoreObject, error)
+}
+
+// listNames lists the directory at p in s, with the modification times of the
+// files only if they come for free
+func listNames(s ReadableStorage, p string) ([]StoreObject, error) {
+	if l, ok := s.(nameLister); ok {
+		return l.listNames(p)
+	}
+	return s.List(p)
+}
+
+// namesOnly lists its storage with listNames, for instance to give it to
+// GetTree when the modification times are not needed
+type namesOnly struct {
+	ReadableStorage
+}
+
+func (n namesOnly) List(p string) ([]StoreObject, error) {
+	return listNames(n.ReadableStorage, p)
+}
+
+// atomicUploader is implemented by the storages whose uploads are atomic: a
+// file is only visible once it is complete, even if the upload is interrupted
+type atomicUploader interface {
+	atomicUploads()
+}
+
+// hasAtomicUploads returns whether the uploads to s are atomic, the ones of
+// an EncryptedStorage are if the ones of its backend are
+func hasAtomicUploads(s Storage) bool {
+	if e, ok := s.(*EncryptedStorage); ok {
+		s = e.backend
+	}
+	_, ok := s.(atomicUploader)
+	return ok
+}
+
 // Storage defines the base method that any storage should implement
 // It only defines an interface to backup data
 type Storage interface {
-	Download(path string) (io.ReadCloser, error)
-	List(path string) ([]StoreObject, error)
+	ReadableStorage
 	Mkdir(path string) error
 	Move(src, dst string) error
 	Remove(path string) error
@@ -1,7 +1,15 @@
 package storage
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"io"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -17,7 +25,8 @@ func (n sortAlphabeticalSyncNode) Swap(i, j int)      { n[i], n[j] = n[j], n[i]
 // SyncNode represents a tree node for StoreObjects
 type SyncNode struct {
 	StoreObject
-	Children []SyncNode
+	Children []SyncNode `json:"children,omitempty"`
+	Chunks   []string   `json:"chunks,omitempty"` // Hashes of the chunks of a file in a Repository
 }
 
 // IsZero returns whether node is empty
@@ -28,36 +37,117 @@ func (n SyncNode) String() string {
 	return n.StoreObject.String()
 }
 
+// DefaultListWorkers is the number of directories GetTree lists at the same time
+const DefaultListWorkers = 8
+
+// DefaultTransfers is the number of files a sync copies at the same time
+// when SyncOptions.Transfers is not set
+const DefaultTransfers = 4
+
 // GetTree do a BFS search to generate a tree starting at root
-// and generates a listing of all the nodes
-func GetTree(s Storage, me StoreObject, path string) (SyncNode, error) {
-	listing, err := s.List(path)
-	if err != nil {
-		return SyncNode{}, errors.Wrap(err, "failed to get tree")
+// and generates a listing of all the nodes, sorted by name. The
+// directories are listed by DefaultListWorkers workers
+func GetTree(s ReadableStorage, me StoreObject, path string) (SyncNode, error) {
+	return GetTreeWithWorkers(s, me, path, DefaultListWorkers)
+}
+
+// walkNode is a directory being listed by a treeWalker
+type walkNode struct {
+	obj      StoreObject
+	path     string
+	files    []SyncNode
+	children []*walkNode
+}
+
+// tree returns the SyncNode of n, once it is listed
+func (n *walkNode) tree() SyncNode {
+	children := append(make([]SyncNode, 0, len(n.files)+len(n.children)), n.files...)
+	for _, c := range n.children {
+		children = append(children, c.tree())
 	}
+	sort.Sort(sortAlphabeticalSyncNode(children))
+	return SyncNode{StoreObject: n.obj, Children: children}
+}
 
-	children := make([]SyncNode, len(listing))
-	for i, l := range listing {
-		if l.IsDirectory {
-			node, localErr := GetTree(s, l, path+"/"+l.Name)
-			if err == nil && localErr != nil {
-				err = localErr
+// treeWalker lists the directories queued by its workers until there are none left
+type treeWalker struct {
+	s       ReadableStorage
+	mu      sync.Mutex
+	cond    *sync.Cond
+	queue   []*walkNode
+	pending int // Directories queued or being listed
+	errs    MultiError
+}
+
+func (w *treeWalker) work() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for {
+		for len(w.queue) == 0 && w.pending > 0 {
+			w.cond.Wait()
+		}
+		if w.pending == 0 {
+			return
+		}
+		n := w.queue[len(w.queue)-1]
+		w.queue = w.queue[:len(w.queue)-1]
+		w.mu.Unlock()
+		listing, err := w.s.List(n.path)
+		w.mu.Lock()
+		w.pending--
+		if err != nil {
+			w.errs = append(w.errs, &FileError{Path: n.path, Err: errors.Wrap(err, "failed to list "+n.path)})
+		}
+		for _, l := range listing {
+			if !l.IsDirectory {
+				n.files = append(n.files, SyncNode{StoreObject: l})
+				continue
 			}
-			children[i] = node
-		} else {
-			node := SyncNode{StoreObject: l}
-			children[i] = node
+			child := &walkNode{obj: l, path: n.path + "/" + l.Name}
+			n.children = append(n.children, child)
+			w.queue = append(w.queue, child)
+			w.pending++
 		}
+		w.cond.Broadcast()
 	}
-	return SyncNode{
-		StoreObject: me,
-		Children:    children,
-	}, err
 }
 
-// DiffTree returns the different tree of nodes that are in n1 but not in n2
+// GetTreeWithWorkers is GetTree with the directories listed by the given
+// number of workers. The directories that can't be listed are left empty
+// and all their errors (FileErrors) are returned
+func GetTreeWithWorkers(s ReadableStorage, me StoreObject, path string, workers int) (SyncNode, error) {
+	root := &walkNode{obj: me, path: path}
+	w := &treeWalker{s: s, queue: []*walkNode{root}, pending: 1}
+	w.cond = sync.NewCond(&w.mu)
+	if workers < 1 {
+		workers = 1
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.work()
+		}()
+	}
+	wg.Wait()
+
+	sort.Slice(w.errs, func(i, j int) bool { return w.errs[i].Error() < w.errs[j].Error() })
+	return root.tree(), errors.Wrap(w.errs.errorOrNil(), "failed to get tree")
+}
+
+// DiffTree returns the different tree of nodes that are in n1 but not in n2.
+// Directories are only compared by their content: their modification time
+// changes as soon as something is written in them
 func DiffTree(n1, n2 SyncNode) SyncNode {
-	if !n1.StoreObject.Equal(n2.StoreObject) {
+	return DiffTreeFunc(n1, n2, StoreObject.Equal)
+}
+
+// DiffTreeFunc is DiffTree with the files compared with equal, for instance
+// StoreObject.EqualContent
+func DiffTreeFunc(n1, n2 SyncNode, equal func(a, b StoreObject) bool) SyncNode {
+	sameDirectory := n1.IsDirectory && n2.IsDirectory && n1.Name == n2.Name
+	if !sameDirectory && !equal(n1.StoreObject, n2.StoreObject) {
 		return n1
 	}
 	children2 := make(map[string]SyncNode, len(n2.Children))
@@ -69,7 +159,7 @@ func DiffTree(n1, n2 SyncNode) SyncNode {
 
 	for _, n1Child := range n1.Children {
 		if n2Child, ok := children2[n1Child.Name]; ok {
-			n := DiffTree(n1Child, n2Child)
+			n := DiffTreeFunc(n1Child, n2Child, equal)
 			if !n.IsZero() {
 				changedChildren = append(changedChildren, n)
 			}
@@ -87,67 +177,362 @@ func DiffTree(n1, n2 SyncNode) SyncNode {
 	}
 }
 
+// ExtraTree returns the tree of nodes that are in n1 but whose name is not
+// in n2. Nodes that changed type (file <-> directory) are also returned
+func ExtraTree(n1, n2 SyncNode) SyncNode {
+	children2 := make(map[string]SyncNode, len(n2.Children))
+	for _, c := range n2.Children {
+		children2[c.Name] = c
+	}
+
+	extraChildren := make([]SyncNode, 0, len(n1.Children))
+	for _, n1Child := range n1.Children {
+		n2Child, ok := children2[n1Child.Name]
+		if !ok || n1Child.IsDirectory != n2Child.IsDirectory {
+			extraChildren = append(extraChildren, n1Child)
+			continue
+		}
+		if n1Child.IsDirectory {
+			n := ExtraTree(n1Child, n2Child)
+			if !n.IsZero() {
+				extraChildren = append(extraChildren, n)
+			}
+		}
+	}
+
+	if len(extraChildren) == 0 {
+		return SyncNode{}
+	}
+	return SyncNode{
+		StoreObject: n1.StoreObject,
+		Children:    extraChildren,
+	}
+}
+
+// copyFile copies the file at srcPath in src to dstPath in dst, with modTime
+// as modification time. It returns the hash of the content (see StoreObject)
+func copyFile(src ReadableStorage, srcPath string, dst Storage, dstPath string, modTime time.Time) (string, error) {
+	srcFile, err := src.Download(srcPath)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to open "+srcPath)
+	}
+	defer srcFile.Close()
+	hash, err := uploadFile(srcFile, dst, dstPath, modTime)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to copy "+srcPath+" to "+dstPath)
+	}
+	return hash, nil
+}
+
+// uploadFile writes the content of r to dstPath in dst, with modTime as
+// modification time. It returns the hash of the content (see StoreObject)
+func uploadFile(r io.Reader, dst Storage, dstPath string, modTime time.Time) (string, error) {
+	dstFile, err := dst.Upload(dstPath, modTime)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to open "+dstPath)
+	}
+	hash := sha256.New()
+	_, err = io.Copy(dstFile, io.TeeReader(r, hash))
+	err2 := dstFile.Close()
+	if err == nil {
+		err = err2
+	}
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// replacedTree returns the nodes of dstNode that are files in both diff
+// (see DiffTree) and dstNode, so the ones a sync overwrites
+func replacedTree(diff, dstNode SyncNode) SyncNode {
+	dstChildren := make(map[string]SyncNode, len(dstNode.Children))
+	for _, c := range dstNode.Children {
+		dstChildren[c.Name] = c
+	}
+	replacedChildren := make([]SyncNode, 0, len(diff.Children))
+	for _, c := range diff.Children {
+		dstChild, ok := dstChildren[c.Name]
+		if !ok || c.IsDirectory != dstChild.IsDirectory {
+			continue
+		}
+		if !c.IsDirectory {
+			replacedChildren = append(replacedChildren, dstChild)
+			continue
+		}
+		if n := replacedTree(c, dstChild); !n.IsZero() {
+			replacedChildren = append(replacedChildren, n)
+		}
+	}
+	if len(replacedChildren) == 0 {
+		return SyncNode{}
+	}
+	return SyncNode{
+		StoreObject: dstNode.StoreObject,
+		Children:    replacedChildren,
+	}
+}
+
+// filePaths returns the relative paths of the files of n
+func filePaths(n SyncNode) map[string]bool {
+	paths := make(map[string]bool)
+	if n.IsZero() {
+		return paths
+	}
+	var walk func(n SyncNode, relative string)
+	walk = func(n SyncNode, relative string) {
+		if !n.IsDirectory {
+			paths[relative] = true
+			return
+		}
+		for _, c := range n.Children {
+			walk(c, path.Join(relative, c.Name))
+		}
+	}
+	walk(n, "")
+	return paths
+}
+
+// SyncOptions tunes the behavior of SyncWithOptions
+type SyncOptions struct {
+	// BinRetention is applied to the bin of dst at the end of the sync
+	BinRetention RetentionPolicy
+	// Checksum compares the files by their Hash instead of their modification
+	// time. The hashes are computed when the backends don't give them, so it
+	// reads all the source; the ones of dst are taken from its latest
+	// snapshot when possible
+	Checksum bool
+	// Transfers is the number of files copied at the same time,
+	// DefaultTransfers if not set
+	Transfers int
+	// ContinueOnError keeps syncing the other files when a file or directory
+	// of src can't be read or copied. They are left as they are in dst, and
+	// out of the snapshot, and SyncWithOptions returns a PartialSyncError
+	ContinueOnError bool
+	// Index, if set, is used instead of listing dst when it is up to date,
+	// and updated at the end of the sync
+	Index *Index
+}
+
+// PartialSyncError is returned by SyncWithOptions, with ContinueOnError, when
+// the sync finished without some of the files
+type PartialSyncError struct {
+	Files []*FileError // Paths in the source
+}
+
+func (e *PartialSyncError) Error() string {
+	return fmt.Sprintf("%d files could not be synced", len(e.Files))
+}
+
+// skippedFiles collects the files of the source skipped by a sync with
+// ContinueOnError
+type skippedFiles struct {
+	root  string
+	errs  []*FileError
+	paths map[string]bool // Relative to root
+}
+
+// add records the files of err if it is only made of FileErrors of files in
+// root (err may be nil). Otherwise, or if s is nil, err is returned as the
+// sync must stop
+func (s *skippedFiles) add(err error) error {
+	if err == nil || s == nil {
+		return err
+	}
+	files, ok := asFileErrors(err)
+	if !ok {
+		return err
+	}
+	for _, f := range files {
+		relative := strings.TrimPrefix(f.Path, s.root+"/")
+		if relative == f.Path || relative == "" {
+			return err
+		}
+	}
+	for _, f := range files {
+		log.Warnf("Skipping %s: %s", f.Path, f.Err)
+		s.errs = append(s.errs, f)
+		s.paths[strings.TrimPrefix(f.Path, s.root+"/")] = true
+	}
+	return nil
+}
+
+// prune returns n without the skipped files
+func (s *skippedFiles) prune(n SyncNode) SyncNode {
+	if s == nil || len(s.paths) == 0 {
+		return n
+	}
+	return withoutPaths(n, "", s.paths)
+}
+
+// withoutPaths returns n, at relative, without the nodes whose relative path
+// is in paths
+func withoutPaths(n SyncNode, relative string, paths map[string]bool) SyncNode {
+	children := make([]SyncNode, 0, len(n.Children))
+	for _, c := range n.Children {
+		p := path.Join(relative, c.Name)
+		if paths[p] {
+			continue
+		}
+		if c.IsDirectory {
+			c = withoutPaths(c, p, paths)
+		}
+		children = append(children, c)
+	}
+	n.Children = children
+	return n
+}
+
 // Sync copies everything from src to dst. If there are more things in dst,
-// move them to the Bin
-// Bin -> ToDo
-func Sync(src Storage, srcRoot string, dst Storage, dstRoot string) error {
+// move them to the Bin: BinDirectory/<timestamp>/ at the root of dst,
+// keeping their relative path. The previous version of the files that are
+// overwritten are moved there too, so the snapshot of dst (see Snapshot)
+// saved at the end of each sync that changed it can be restored later, until
+// the bin generations it needs are purged
+func Sync(src ReadableStorage, srcRoot string, dst Storage, dstRoot string) error {
+	return SyncWithOptions(src, srcRoot, dst, dstRoot, SyncOptions{})
+}
+
+// SyncWithOptions is Sync with the behavior tuned by opts
+func SyncWithOptions(src ReadableStorage, srcRoot string, dst Storage, dstRoot string, opts SyncOptions) error {
 	srcRootObj := StoreObject{}
 	// ToDo: Cleaner error check
 	if _, err := src.List(srcRoot); err == nil {
 		srcRootObj.IsDirectory = true
 	}
-	dstRootObj := StoreObject{}
-	if _, err := dst.List(dstRoot); err == nil {
-		dstRootObj.IsDirectory = true
+	var skipped *skippedFiles
+	if opts.ContinueOnError {
+		skipped = &skippedFiles{root: srcRoot, paths: make(map[string]bool)}
 	}
-
 	srcTree, err := GetTree(src, srcRootObj, srcRoot)
-	if err != nil {
+	if err = skipped.add(err); err != nil {
 		return err
 	}
-	dstTree, err2 := GetTree(dst, dstRootObj, dstRoot)
-	if err2 != nil {
-		return err2
+	srcTree = withoutReserved(srcTree)
+
+	var dstTree, previous SyncNode
+	var index indexContent
+	var used func(name string) bool
+	cached, hasSnapshot := false, false
+	if opts.Index != nil {
+		index, cached = opts.Index.load(dst, dstRoot)
+		if err = opts.Index.invalidate(); err != nil {
+			return err
+		}
 	}
-	diff := DiffTree(srcTree, dstTree)
-	if diff.IsZero() { // Nothing to do
+	if cached {
+		log.Info("Using the index of the destination")
+		dstTree, previous = index.Tree, index.Tree
+		hasSnapshot = true // Written by the sync that saved the index
+		// Nothing was written in the destination since that sync, so no
+		// generation is after its own
+		used = func(name string) bool { return name <= index.Generation }
+	} else {
+		dstRootObj := StoreObject{}
+		if _, err := dst.List(dstRoot); err == nil {
+			dstRootObj.IsDirectory = true
+		}
+		dstTree, err = GetTree(dst, dstRootObj, dstRoot)
+		if err != nil {
+			return err
+		}
+		dstTree = withoutReserved(dstTree)
+		previous, hasSnapshot, err = latestSnapshot(dst, dstRoot)
+		if err != nil {
+			return err
+		}
+		// An out of date index still knows the hashes of the files that
+		// didn't change, the snapshots can't be read with public keys only
+		if previous.IsZero() {
+			previous = index.Tree
+		}
+		generations, err := usedGenerations(dst, dstRoot)
+		if err != nil {
+			return err
+		}
+		used = func(name string) bool { return generations[name] }
+	}
+	equal := StoreObject.Equal
+	if opts.Checksum {
+		equal = StoreObject.EqualContent
+		srcTree, err = fillHashes(src, srcRoot, srcTree, SyncNode{}, opts.ContinueOnError)
+		if err = skipped.add(err); err != nil {
+			return err
+		}
+		dstTree, err = fillHashes(dst, dstRoot, dstTree, previous, false)
+		if err != nil {
+			return err
+		}
+	}
+	// The skipped files are left as they are in dst
+	srcTree, dstTree = skipped.prune(srcTree), skipped.prune(dstTree)
+	diff := DiffTreeFunc(srcTree, dstTree, equal)
+	extra := ExtraTree(dstTree, srcTree)
+	if diff.IsZero() && extra.IsZero() { // Nothing to do
 		log.Info("Directories are in sync")
-		return nil
 	}
-	var dfsWalk func(n SyncNode, srcPath, dstPath string) error
-	dfsWalk = func(n SyncNode, srcPath, dstPath string) error {
-		srcPath = srcPath + "/" + n.Name
-		dstPath = dstPath + "/" + n.Name
-		if !n.IsDirectory {
-			log.Infof("Copying %s", dstPath)
-			srcFile, err := src.Download(srcPath)
-			if err != nil {
-				return errors.Wrap(err, "failed to open "+srcPath)
-			}
-			defer srcFile.Close()
-			dstFile, err := dst.Upload(dstPath, n.Modified)
-			if err != nil {
-				return errors.Wrap(err, "failed to open "+dstPath)
-			}
-			defer dstFile.Close()
-			_, err = io.Copy(dstFile, srcFile)
-			if err != nil {
-				return errors.Wrap(err, "failed to copy "+srcPath+" to "+dstPath)
-			}
-		} else {
-			err := dst.Mkdir(dstPath)
-			if err != nil {
-				return errors.Wrap(err, "failed to create directory "+dstPath)
-			}
-			for _, c := range n.Children {
-				err = dfsWalk(c, srcPath, dstPath)
-				if err != nil {
-					return err
-				}
-			}
+	token, err := writeIndexToken(dst, dstRoot)
+	if err != nil {
+		return err
+	}
+	syncTime := generationTime(now(), used)
+	binPath := dstRoot + "/" + BinDirectory + "/" + syncTime.Format(binTimeFormat)
+	if !extra.IsZero() {
+		err = moveExtraToBin(dst, extra, srcTree, dstRoot, binPath)
+		if err != nil {
+			return err
+		}
+	}
+	hashes := make(map[string]string)
+	if !diff.IsZero() {
+		// The files overwritten are moved to the bin as their new version is
+		// copied, so they stay in dst if it can't be
+		transfers := opts.Transfers
+		if transfers < 1 {
+			transfers = DefaultTransfers
+		}
+		t := newTransferScheduler(src, srcRoot, dst, dstRoot, transfers)
+		t.continueOnError = opts.ContinueOnError
+		t.replaced, t.binPath = filePaths(replacedTree(diff, dstTree)), binPath
+		t.copyTree(diff, "")
+		hashes, err = t.wait()
+		if err = skipped.add(err); err != nil {
+			return err
 		}
-		return nil
 	}
 
-	return dfsWalk(diff, srcRoot, dstRoot)
+	// The hashes of the snapshot are the ones of the copied files, the ones
+	// of the previous snapshot for the files that didn't change, or computed
+	tree := setHashes(skipped.prune(srcTree), "", hashes)
+	tree, err = fillHashes(src, srcRoot, tree, previous, opts.ContinueOnError)
+	if err = skipped.add(err); err != nil {
+		return err
+	}
+	// The latest snapshot is still the state of dst if nothing changed. With
+	// Checksum, files are not copied when only their modification time did
+	changed := !diff.IsZero() || !extra.IsZero() || (skipped != nil && len(skipped.errs) > 0)
+	if opts.Checksum && !previous.IsZero() {
+		changed = changed || !DiffTreeFunc(tree, previous, StoreObject.Equal).IsZero()
+	}
+	if changed || !hasSnapshot {
+		err = writeSnapshot(dst, dstRoot, Snapshot{
+			ID:   syncTime.Format(binTimeFormat),
+			Time: syncTime,
+			Tree: skipped.prune(tree),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	// The index would miss the skipped files that are in dst
+	if opts.Index != nil && (skipped == nil || len(skipped.errs) == 0) {
+		if err = opts.Index.save(token, tree, syncTime.Format(binTimeFormat)); err != nil {
+			return err
+		}
+	}
+	_, err = NewBin(dst, dstRoot).ApplyRetention(opts.BinRetention)
+	if err != nil || skipped == nil || len(skipped.errs) == 0 {
+		return err
+	}
+	return &PartialSyncError{Files: skipped.errs}
 }
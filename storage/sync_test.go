@@ -1,10 +1,16 @@
 package storage
 
 import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"sort"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -36,6 +42,75 @@ func TestSyncGetTree(t *testing.T) {
 	assert.Len(folderA.Children[1].Children, 0)
 }
 
+// slowStorage fails to list the paths in fail and records the maximum
+// number of concurrent listings
+type slowStorage struct {
+	Storage
+	fail    map[string]bool
+	mu      sync.Mutex
+	current int
+	max     int
+}
+
+func (s *slowStorage) List(p string) ([]StoreObject, error) {
+	s.mu.Lock()
+	s.current++
+	if s.current > s.max {
+		s.max = s.current
+	}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.current--
+		s.mu.Unlock()
+	}()
+	time.Sleep(time.Millisecond)
+	if s.fail[p] {
+		return nil, ErrNotExist
+	}
+	return s.Storage.List(p)
+}
+
+func TestSyncGetTreeWorkers(t *testing.T) {
+	assert := assert.New(t)
+	local, cleanup := newTempLocalStorage(t)
+	defer cleanup()
+	for _, d := range []string{"a", "b", "c", "d"} {
+		for _, f := range []string{"z", "y", "x"} {
+			writeFile(t, local.Root, d+"/"+f+"/file_"+f, f)
+		}
+		writeFile(t, local.Root, "file_"+d, d)
+	}
+
+	s := &slowStorage{Storage: local}
+	serial, err := GetTreeWithWorkers(s, StoreObject{IsDirectory: true}, ".", 1)
+	assert.NoError(err)
+	assert.Equal(1, s.max)
+	s.max = 0
+	parallel, err := GetTreeWithWorkers(s, StoreObject{IsDirectory: true}, ".", 4)
+	assert.NoError(err)
+	assert.Equal(serial, parallel)
+	assert.True(s.max > 1 && s.max <= 4, "at most 4 directories should be listed at once")
+	if assert.Len(parallel.Children, 8) && assert.Len(parallel.Children[0].Children, 3) {
+		assert.Equal("a", parallel.Children[0].Name)
+		assert.Equal("x", parallel.Children[0].Children[0].Name)
+		assert.Equal("file_a", parallel.Children[4].Name)
+	}
+
+	// The errors of all the directories are returned
+	s.fail = map[string]bool{"./a": true}
+	tree, err := GetTree(s, StoreObject{IsDirectory: true}, ".")
+	assert.Equal(ErrNotExist, errors.Cause(err))
+	assert.Len(tree.Children, 8)
+	assert.Empty(tree.Children[0].Children)
+	s.fail["./b/y"] = true
+	_, err = GetTree(s, StoreObject{IsDirectory: true}, ".")
+	if listErrors, ok := errors.Cause(err).(MultiError); assert.True(ok) && assert.Len(listErrors, 2) {
+		assert.Contains(listErrors[0].Error(), "./a")
+		assert.Contains(listErrors[1].Error(), "./b/y")
+	}
+}
+
 func TestSyncDiffTree(t *testing.T) {
 	assert := assert.New(t)
 	/*
@@ -154,3 +229,327 @@ func TestSyncDiffTree(t *testing.T) {
 	diff := DiffTree(node1, node2)
 	assert.Equal(expected, diff)
 }
+
+func TestSyncDiffTreeDirectories(t *testing.T) {
+	assert := assert.New(t)
+	date1 := time.Date(2017, time.January, 10, 9, 55, 3, 0, time.UTC)
+	date2 := time.Date(2017, time.January, 10, 8, 55, 3, 0, time.UTC)
+	file := SyncNode{StoreObject: StoreObject{Name: "file_aa", Size: 10, Modified: date1}}
+
+	// Only the content of directories is compared
+	node1 := SyncNode{
+		StoreObject: StoreObject{Name: "/", IsDirectory: true},
+		Children: []SyncNode{
+			SyncNode{StoreObject: StoreObject{Name: "folder_a", IsDirectory: true, Modified: date1}, Children: []SyncNode{file}},
+		},
+	}
+	node2 := SyncNode{
+		StoreObject: StoreObject{Name: "/", IsDirectory: true},
+		Children: []SyncNode{
+			SyncNode{StoreObject: StoreObject{Name: "folder_a", IsDirectory: true, Modified: date2}, Children: []SyncNode{file}},
+		},
+	}
+	assert.True(DiffTree(node1, node2).IsZero())
+
+	// Files can be compared by their content
+	hashed1, hashed2 := node1, node2
+	hashed1.Children = []SyncNode{node1.Children[0]}
+	hashed1.Children[0].Children = []SyncNode{file}
+	hashed1.Children[0].Children[0].Hash = "hash"
+	hashed2.Children = []SyncNode{node2.Children[0]}
+	hashed2.Children[0].Children = []SyncNode{file}
+	hashed2.Children[0].Children[0].Modified = date2
+	hashed2.Children[0].Children[0].Hash = "hash"
+	assert.True(DiffTreeFunc(hashed1, hashed2, StoreObject.EqualContent).IsZero())
+	assert.False(DiffTree(hashed1, hashed2).IsZero())
+	hashed2.Children[0].Children[0].Hash = "other"
+	assert.Equal(hashed1, DiffTreeFunc(hashed1, hashed2, StoreObject.EqualContent))
+
+	// But a file replaced by a directory is different
+	node2.Children = []SyncNode{
+		SyncNode{StoreObject: StoreObject{Name: "folder_a", Size: 10, Modified: date1}},
+	}
+	assert.Equal(node1, DiffTree(node1, node2))
+}
+
+func TestSyncExtraTree(t *testing.T) {
+	assert := assert.New(t)
+	/*
+		/file_a
+		/file_b
+		/folder_a/file_aa
+		/folder_a/file_ab
+		/folder_b/file_ba
+		/folder_c (directory)
+
+		VS
+
+		/file_a
+		/folder_a/file_aa
+		/folder_c (file)
+
+		should return
+		/file_b
+		/folder_a/file_ab
+		/folder_b/file_ba
+		/folder_c
+	*/
+	node1 := SyncNode{
+		StoreObject: StoreObject{Name: "/", IsDirectory: true},
+		Children: []SyncNode{
+			SyncNode{StoreObject: StoreObject{Name: "file_a"}},
+			SyncNode{StoreObject: StoreObject{Name: "file_b"}},
+			SyncNode{
+				StoreObject: StoreObject{Name: "folder_a", IsDirectory: true},
+				Children: []SyncNode{
+					SyncNode{StoreObject: StoreObject{Name: "file_aa"}},
+					SyncNode{StoreObject: StoreObject{Name: "file_ab"}},
+				},
+			},
+			SyncNode{
+				StoreObject: StoreObject{Name: "folder_b", IsDirectory: true},
+				Children: []SyncNode{
+					SyncNode{StoreObject: StoreObject{Name: "file_ba"}},
+				},
+			},
+			SyncNode{StoreObject: StoreObject{Name: "folder_c", IsDirectory: true}},
+		},
+	}
+	node2 := SyncNode{
+		StoreObject: StoreObject{Name: "/", IsDirectory: true},
+		Children: []SyncNode{
+			SyncNode{StoreObject: StoreObject{Name: "file_a"}},
+			SyncNode{
+				StoreObject: StoreObject{Name: "folder_a", IsDirectory: true},
+				Children: []SyncNode{
+					SyncNode{StoreObject: StoreObject{Name: "file_aa"}},
+				},
+			},
+			SyncNode{StoreObject: StoreObject{Name: "folder_c"}},
+		},
+	}
+	expected := SyncNode{
+		StoreObject: StoreObject{Name: "/", IsDirectory: true},
+		Children: []SyncNode{
+			SyncNode{StoreObject: StoreObject{Name: "file_b"}},
+			SyncNode{
+				StoreObject: StoreObject{Name: "folder_a", IsDirectory: true},
+				Children: []SyncNode{
+					SyncNode{StoreObject: StoreObject{Name: "file_ab"}},
+				},
+			},
+			SyncNode{
+				StoreObject: StoreObject{Name: "folder_b", IsDirectory: true},
+				Children: []SyncNode{
+					SyncNode{StoreObject: StoreObject{Name: "file_ba"}},
+				},
+			},
+			SyncNode{StoreObject: StoreObject{Name: "folder_c", IsDirectory: true}},
+		},
+	}
+
+	assert.Equal(expected, ExtraTree(node1, node2))
+	assert.True(ExtraTree(node2, node2).IsZero())
+}
+
+// newTempLocalStorage returns an empty LocalStorage and a function to remove it
+func newTempLocalStorage(t *testing.T) (*LocalStorage, func()) {
+	root, err := ioutil.TempDir("", "tri_sync_test_")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %s", err)
+	}
+	s, err := NewLocalStorage(root)
+	if err != nil {
+		os.RemoveAll(root)
+		t.Fatalf("Failed to create local storage: %s", err)
+	}
+	return s, func() { os.RemoveAll(root) }
+}
+
+// writeFile creates the file at path (and its parents) in root
+func writeFile(t *testing.T, root, path, content string) {
+	abs := filepath.Join(root, filepath.FromSlash(path))
+	err := os.MkdirAll(filepath.Dir(abs), 0770)
+	if err == nil {
+		err = ioutil.WriteFile(abs, []byte(content), 0660)
+	}
+	if err != nil {
+		t.Fatalf("Failed to write %s: %s", path, err)
+	}
+}
+
+func TestSyncBin(t *testing.T) {
+	assert := assert.New(t)
+	src, cleanupSrc := newTempLocalStorage(t)
+	defer cleanupSrc()
+	dst, cleanupDst := newTempLocalStorage(t)
+	defer cleanupDst()
+
+	writeFile(t, src.Root, "file_a", "a")
+	writeFile(t, src.Root, "folder_a/file_aa", "aa")
+	writeFile(t, src.Root, "folder_a/file_ab", "ab")
+	writeFile(t, src.Root, "folder_b/file_ba", "ba")
+	if !assert.NoError(Sync(src, ".", dst, ".")) {
+		t.FailNow()
+	}
+
+	// Delete files in source, they should end up in the bin
+	defer func() { now = time.Now }()
+	now = func() time.Time { return time.Date(2017, time.May, 17, 20, 10, 6, 0, time.UTC) }
+	assert.NoError(os.Remove(filepath.Join(src.Root, "folder_a", "file_ab")))
+	assert.NoError(os.RemoveAll(filepath.Join(src.Root, "folder_b")))
+	if !assert.NoError(Sync(src, ".", dst, ".")) {
+		t.FailNow()
+	}
+
+	binRoot := filepath.Join(dst.Root, BinDirectory, "20170517-201006")
+	content, err := ioutil.ReadFile(filepath.Join(binRoot, "folder_a", "file_ab"))
+	assert.NoError(err)
+	assert.Equal("ab", string(content))
+	content, err = ioutil.ReadFile(filepath.Join(binRoot, "folder_b", "file_ba"))
+	assert.NoError(err)
+	assert.Equal("ba", string(content))
+
+	_, err = os.Stat(filepath.Join(dst.Root, "folder_a", "file_ab"))
+	assert.True(os.IsNotExist(err), "file should have been moved to the bin")
+	_, err = os.Stat(filepath.Join(dst.Root, "folder_b"))
+	assert.True(os.IsNotExist(err), "folder should have been moved to the bin")
+	_, err = os.Stat(filepath.Join(dst.Root, "folder_a", "file_aa"))
+	assert.NoError(err, "file still in source should be kept")
+
+	// The bin should not be synced nor moved to itself
+	assert.NoError(Sync(src, ".", dst, "."))
+	entries, err := ioutil.ReadDir(filepath.Join(dst.Root, BinDirectory))
+	assert.NoError(err)
+	assert.Len(entries, 1)
+}
+
+func TestSyncChecksum(t *testing.T) {
+	assert := assert.New(t)
+	src, cleanupSrc := newTempLocalStorage(t)
+	defer cleanupSrc()
+	dst, cleanupDst := newTempLocalStorage(t)
+	defer cleanupDst()
+	target, cleanupTarget := newTempLocalStorage(t)
+	defer cleanupTarget()
+	defer func() { now = time.Now }()
+	now = func() time.Time { return time.Date(2017, time.May, 17, 20, 1, 0, 0, time.UTC) }
+	date1 := time.Date(2017, time.January, 10, 9, 55, 3, 0, time.UTC)
+	date2 := time.Date(2017, time.January, 10, 8, 55, 3, 0, time.UTC)
+	setModified := func(root, p string, modTime time.Time) {
+		assert.NoError(os.Chtimes(filepath.Join(root, filepath.FromSlash(p)), modTime, modTime))
+	}
+	checksum := SyncOptions{Checksum: true}
+
+	writeFile(t, src.Root, "folder/file_a", "aaaa")
+	setModified(src.Root, "folder/file_a", date1)
+	assert.NoError(Sync(src, ".", dst, "."))
+
+	// Same size and modification time: only the checksum sees the change
+	now = func() time.Time { return time.Date(2017, time.May, 17, 20, 2, 0, 0, time.UTC) }
+	writeFile(t, src.Root, "folder/file_a", "bbbb")
+	setModified(src.Root, "folder/file_a", date1)
+	assert.NoError(Sync(src, ".", dst, "."))
+	assert.Equal("aaaa", readFile(t, dst.Root, "folder/file_a"))
+	now = func() time.Time { return time.Date(2017, time.May, 17, 20, 3, 0, 0, time.UTC) }
+	assert.NoError(SyncWithOptions(src, ".", dst, ".", checksum))
+	assert.Equal("bbbb", readFile(t, dst.Root, "folder/file_a"))
+	assert.Equal("aaaa", readFile(t, dst.Root, BinDirectory+"/20170517-200300/folder/file_a"))
+
+	// Only the modification time changed: nothing is copied
+	now = func() time.Time { return time.Date(2017, time.May, 17, 20, 4, 0, 0, time.UTC) }
+	setModified(src.Root, "folder/file_a", date2)
+	assert.NoError(SyncWithOptions(src, ".", dst, ".", checksum))
+	info, err := os.Stat(filepath.Join(dst.Root, "folder/file_a"))
+	if assert.NoError(err) {
+		assert.True(date1.Equal(info.ModTime()))
+	}
+	generations, err := NewBin(dst, ".").Generations()
+	assert.NoError(err)
+	assert.Len(generations, 1)
+
+	// But the snapshot can still be restored
+	_, err = Restore(dst, ".", target, ".", RestoreOptions{Snapshot: "20170517-200400"})
+	assert.NoError(err)
+	assert.Equal("bbbb", readFile(t, target.Root, "folder/file_a"))
+}
+
+// unreadableStorage fails to list or download the paths in fail
+type unreadableStorage struct {
+	Storage
+	fail map[string]bool
+}
+
+func (s unreadableStorage) List(p string) ([]StoreObject, error) {
+	if s.fail[p] {
+		return nil, os.ErrPermission
+	}
+	return s.Storage.List(p)
+}
+
+func (s unreadableStorage) Download(p string) (io.ReadCloser, error) {
+	if s.fail[p] {
+		return nil, os.ErrPermission
+	}
+	return s.Storage.Download(p)
+}
+
+func TestSyncContinueOnError(t *testing.T) {
+	assert := assert.New(t)
+	local, cleanupSrc := newTempLocalStorage(t)
+	defer cleanupSrc()
+	dst, cleanupDst := newTempLocalStorage(t)
+	defer cleanupDst()
+	defer func() { now = time.Now }()
+	now = func() time.Time { return time.Date(2017, time.May, 17, 20, 1, 0, 0, time.UTC) }
+	writeFile(t, local.Root, "folder/file_a", "a")
+	writeFile(t, local.Root, "folder/file_b", "b")
+	writeFile(t, local.Root, "unreadable/file_c", "c")
+	writeFile(t, local.Root, "file_d", "d")
+	assert.NoError(Sync(local, ".", dst, "."))
+
+	now = func() time.Time { return time.Date(2017, time.May, 17, 20, 2, 0, 0, time.UTC) }
+	writeFile(t, local.Root, "folder/file_b", "new b")
+	writeFile(t, local.Root, "unreadable/file_e", "e")
+	writeFile(t, local.Root, "file_d", "new d")
+	src := unreadableStorage{Storage: local, fail: map[string]bool{"./folder/file_b": true, "./unreadable": true}}
+
+	// By default the first error stops the sync
+	err := Sync(src, ".", dst, ".")
+	if assert.Error(err) {
+		_, partial := err.(*PartialSyncError)
+		assert.False(partial)
+	}
+	assert.Equal("d", readFile(t, dst.Root, "file_d"))
+
+	// But the other files can be synced
+	err = SyncWithOptions(src, ".", dst, ".", SyncOptions{ContinueOnError: true})
+	partial, ok := err.(*PartialSyncError)
+	if assert.True(ok, "got %v", err) && assert.Len(partial.Files, 2) {
+		paths := []string{partial.Files[0].Path, partial.Files[1].Path}
+		sort.Strings(paths)
+		assert.Equal([]string{"./folder/file_b", "./unreadable"}, paths)
+		assert.Equal(os.ErrPermission, errors.Cause(partial.Files[0]))
+	}
+	assert.Equal("new d", readFile(t, dst.Root, "file_d"))
+	assert.Equal("a", readFile(t, dst.Root, "folder/file_a"))
+	assert.Equal("b", readFile(t, dst.Root, "folder/file_b"), "files that can't be copied are left as they are")
+	_, err = os.Stat(filepath.Join(dst.Root, BinDirectory, "20170517-200200", "folder"))
+	assert.True(os.IsNotExist(err), "file_b should not be moved to the bin")
+	_, err = os.Stat(filepath.Join(dst.Root, "folder", "file_b"+replaceTempSuffix))
+	assert.True(os.IsNotExist(err), "the partial copy should be removed")
+	assert.Equal("c", readFile(t, dst.Root, "unreadable/file_c"), "unreadable directories are left as they are")
+	assert.Equal("d", readFile(t, dst.Root, BinDirectory+"/20170517-200200/file_d"))
+
+	// The snapshot only has the synced files
+	snapshot, err := ReadSnapshot(dst, ".", "20170517-200200")
+	if assert.NoError(err) {
+		_, ok = lookupNode(snapshot.Tree, "folder/file_b")
+		assert.False(ok)
+		_, ok = lookupNode(snapshot.Tree, "unreadable")
+		assert.False(ok)
+		d, ok := lookupNode(snapshot.Tree, "file_d")
+		assert.True(ok)
+		assert.NotEmpty(d.Hash)
+	}
+}
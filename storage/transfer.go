@@ -0,0 +1,169 @@
+package storage
+
+import (
+	"path"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// replaceTempSuffix is appended to the path a new version of a file is
+// uploaded to, before the previous one is moved to the bin
+const replaceTempSuffix = ".tri-tmp"
+
+// transfer is a file copied by a transferScheduler
+type transfer struct {
+	relative string
+	modTime  time.Time
+	replace  bool // A previous version is in dst
+}
+
+// transferScheduler copies files from srcRoot in src to dstRoot in dst with
+// a pool of workers
+type transferScheduler struct {
+	src     ReadableStorage
+	srcRoot string
+	dst     Storage
+	dstRoot string
+	queue   chan transfer
+	wg      sync.WaitGroup
+	// continueOnError keeps queuing transfers after an error
+	continueOnError bool
+	// replaced are the files of dst, by relative path, moved under binPath
+	// once their new version is uploaded. Otherwise they are overwritten
+	replaced map[string]bool
+	binPath  string
+
+	mu     sync.Mutex
+	hashes map[string]string // Hashes of the copied files by relative path
+	errs   MultiError
+}
+
+// newTransferScheduler starts a scheduler with workers parallel transfers
+func newTransferScheduler(src ReadableStorage, srcRoot string, dst Storage, dstRoot string, workers int) *transferScheduler {
+	t := &transferScheduler{
+		src:     src,
+		srcRoot: srcRoot,
+		dst:     dst,
+		dstRoot: dstRoot,
+		queue:   make(chan transfer),
+		hashes:  make(map[string]string),
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		t.wg.Add(1)
+		go t.work()
+	}
+	return t
+}
+
+func (t *transferScheduler) work() {
+	defer t.wg.Done()
+	for f := range t.queue {
+		dstPath := t.dstRoot + "/" + f.relative
+		log.Infof("Copying %s", dstPath)
+		srcPath := t.srcRoot + "/" + f.relative
+		var hash string
+		var err error
+		if f.replace {
+			hash, err = t.replaceFile(srcPath, f)
+		} else {
+			hash, err = copyFile(t.src, srcPath, t.dst, dstPath, f.modTime)
+		}
+		t.mu.Lock()
+		if err != nil {
+			t.errs = append(t.errs, &FileError{Path: srcPath, Err: err})
+		} else {
+			t.hashes[f.relative] = hash
+		}
+		t.mu.Unlock()
+	}
+}
+
+// replaceFile copies the file next to its previous version in dst, then
+// moves the previous version to the bin and the copy in its place. So the
+// previous version stays in dst if the copy fails
+func (t *transferScheduler) replaceFile(srcPath string, f transfer) (string, error) {
+	dstPath := t.dstRoot + "/" + f.relative
+	tmpPath := dstPath + replaceTempSuffix
+	srcFile, err := t.src.Download(srcPath)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to open "+srcPath)
+	}
+	defer srcFile.Close()
+	hash, err := uploadFile(srcFile, t.dst, tmpPath, f.modTime)
+	if err != nil {
+		if err := t.dst.Remove(tmpPath); err != nil {
+			log.Warnf("Failed to remove %s: %s", tmpPath, err)
+		}
+		return "", errors.Wrap(err, "failed to copy "+srcPath+" to "+tmpPath)
+	}
+	binPath := t.binPath + "/" + f.relative
+	if err = t.dst.Mkdir(path.Dir(binPath)); err != nil {
+		return "", errors.Wrap(err, "failed to create directory "+path.Dir(binPath))
+	}
+	log.Infof("Moving %s to bin", dstPath)
+	if err = t.dst.Move(dstPath, binPath); err != nil {
+		return "", errors.Wrap(err, "failed to move "+dstPath+" to "+binPath)
+	}
+	if err = t.dst.Move(tmpPath, dstPath); err != nil {
+		return "", errors.Wrap(err, "failed to move "+tmpPath+" to "+dstPath)
+	}
+	return hash, nil
+}
+
+// failed returns whether a transfer failed
+func (t *transferScheduler) failed() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.errs) > 0
+}
+
+// copyTree creates the directories of tree, at relative, and queues its
+// files. A directory is created before any of its children. Unless
+// continueOnError is set, it stops at the first error, leaving the transfers
+// already started to finish
+func (t *transferScheduler) copyTree(n SyncNode, relative string) {
+	if !t.continueOnError && t.failed() {
+		return
+	}
+	if !n.IsDirectory {
+		t.queue <- transfer{relative: relative, modTime: n.Modified, replace: t.replaced[relative]}
+		return
+	}
+	dstPath := t.dstRoot + "/" + relative
+	if err := t.dst.Mkdir(dstPath); err != nil {
+		t.mu.Lock()
+		t.errs = append(t.errs, &FileError{
+			Path: t.srcRoot + "/" + relative,
+			Err:  errors.Wrap(err, "failed to create directory "+dstPath),
+		})
+		t.mu.Unlock()
+		return
+	}
+	for _, c := range n.Children {
+		t.copyTree(c, path.Join(relative, c.Name))
+	}
+}
+
+// wait waits for the queued transfers and returns the hashes of the copied
+// files, with the errors (FileErrors) of all the ones that failed
+func (t *transferScheduler) wait() (map[string]string, error) {
+	close(t.queue)
+	t.wg.Wait()
+	return t.hashes, t.errs.errorOrNil()
+}
+
+// copyTree copies the files of tree from srcRoot in src to dstRoot in dst,
+// with workers parallel transfers. It returns the hashes of the copied files
+// by relative path. See transferScheduler.copyTree for continueOnError
+func copyTree(src ReadableStorage, srcRoot string, tree SyncNode, dst Storage, dstRoot string, workers int, continueOnError bool) (map[string]string, error) {
+	t := newTransferScheduler(src, srcRoot, dst, dstRoot, workers)
+	t.continueOnError = continueOnError
+	t.copyTree(tree, "")
+	return t.wait()
+}
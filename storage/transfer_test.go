@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"io"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// uploadStorage records the directories created and the maximum number of
+// concurrent uploads. The uploads of the paths in fail fail
+type uploadStorage struct {
+	Storage
+	fail    map[string]bool
+	mu      sync.Mutex
+	dirs    map[string]bool
+	orphans []string // Files uploaded before their directory was created
+	current int
+	max     int
+}
+
+// uploadWriter is a file being uploaded to an uploadStorage
+type uploadWriter struct {
+	io.WriteCloser
+	s *uploadStorage
+}
+
+func (w uploadWriter) Close() error {
+	time.Sleep(time.Millisecond)
+	w.s.mu.Lock()
+	w.s.current--
+	w.s.mu.Unlock()
+	return w.WriteCloser.Close()
+}
+
+func (s *uploadStorage) Mkdir(p string) error {
+	s.mu.Lock()
+	s.dirs[path.Clean(p)] = true
+	s.mu.Unlock()
+	return s.Storage.Mkdir(p)
+}
+
+func (s *uploadStorage) Upload(p string, modTime time.Time) (io.WriteCloser, error) {
+	if s.fail[p] {
+		time.Sleep(10 * time.Millisecond) // So the other transfers are started
+		return nil, ErrNotInRoot
+	}
+	s.mu.Lock()
+	if !s.dirs[path.Dir(path.Clean(p))] {
+		s.orphans = append(s.orphans, p)
+	}
+	s.current++
+	if s.current > s.max {
+		s.max = s.current
+	}
+	s.mu.Unlock()
+	w, err := s.Storage.Upload(p, modTime)
+	if err != nil {
+		return nil, err
+	}
+	return uploadWriter{WriteCloser: w, s: s}, nil
+}
+
+func TestCopyTree(t *testing.T) {
+	assert := assert.New(t)
+	src, cleanupSrc := newTempLocalStorage(t)
+	defer cleanupSrc()
+	backend, cleanupDst := newTempLocalStorage(t)
+	defer cleanupDst()
+	for _, d := range []string{"a", "b/c", "b/d"} {
+		for _, f := range []string{"x", "y", "z"} {
+			writeFile(t, src.Root, d+"/file_"+f, d+f)
+		}
+	}
+	writeFile(t, src.Root, "file_root", "root")
+	tree, err := GetTree(src, StoreObject{IsDirectory: true}, ".")
+	if !assert.NoError(err) {
+		t.FailNow()
+	}
+
+	dst := &uploadStorage{Storage: backend, dirs: make(map[string]bool)}
+	hashes, err := copyTree(src, ".", tree, dst, ".", 4, false)
+	assert.NoError(err)
+	assert.Len(hashes, 10)
+	assert.Empty(dst.orphans, "directories should be created before their files")
+	assert.True(dst.max > 1 && dst.max <= 4, "at most 4 files should be copied at once")
+	assert.Equal("b/dy", readFile(t, backend.Root, "b/d/file_y"))
+	hash, err := FileHash(backend, "b/d/file_y")
+	assert.NoError(err)
+	assert.Equal(hash, hashes["b/d/file_y"])
+
+	// Nothing else is queued after an error but all the errors are returned
+	dst = &uploadStorage{
+		Storage: backend,
+		dirs:    make(map[string]bool),
+		fail:    map[string]bool{"./a/file_x": true, "./a/file_y": true},
+	}
+	_, err = copyTree(src, ".", tree, dst, ".", 2, false)
+	if multi, ok := errors.Cause(err).(MultiError); assert.True(ok, "got %v", err) {
+		assert.Len(multi, 2)
+	}
+	assert.NotContains(dst.dirs, "b/c", "nothing should be copied after the errors")
+
+	// Sync uses it
+	writeFile(t, src.Root, "b/c/file_x", "changed")
+	assert.NoError(SyncWithOptions(src, ".", backend, ".", SyncOptions{Transfers: 4}))
+	assert.Equal("changed", readFile(t, backend.Root, "b/c/file_x"))
+	assert.Equal("root", readFile(t, backend.Root, "file_root"))
+}
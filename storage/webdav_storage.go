@@ -0,0 +1,424 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// webdavNamespace is the namespace of the properties written by tri
+	webdavNamespace = "https://github.com/Viq111/tri"
+	// webdavPasswordEnv is the environment variable holding the password
+	webdavPasswordEnv = "TRI_WEBDAV_PASSWORD"
+)
+
+// webdavPropfind asks for the properties List needs
+var webdavPropfind = []byte(`<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:" xmlns:T="` + webdavNamespace + `"><D:prop>` +
+	`<D:resourcetype/><D:getcontentlength/><D:getlastmodified/><T:mtime/>` +
+	`</D:prop></D:propfind>`)
+
+func init() {
+	Register("webdav", openWebDAV)
+	Register("webdavs", openWebDAV)
+}
+
+// openWebDAV returns the storage at a webdav://[user@]host/path URL, over
+// https with webdavs://, with the password in $TRI_WEBDAV_PASSWORD
+func openWebDAV(u *url.URL) (Storage, error) {
+	config := WebDAVConfig{
+		Username: u.User.Username(),
+		Password: os.Getenv(webdavPasswordEnv),
+	}
+	root := *u
+	root.User = nil
+	root.Scheme = "http"
+	if u.Scheme == "webdavs" {
+		root.Scheme = "https"
+	}
+	config.URL = root.String()
+	s, err := NewWebDAVStorage(config)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// WebDAVConfig is the location of a WebDAV collection and the credentials
+// to access it
+type WebDAVConfig struct {
+	URL      string // Root of the storage, for instance https://nas.local/dav/backups
+	Username string // Basic authentication is used if it is set
+	Password string
+	Client   *http.Client // http.DefaultClient if nil
+}
+
+// WebDAVStorage implements Storage in a WebDAV collection. WebDAV has no way
+// to set the modification time of a resource so it is stored, at the
+// nanosecond, in a dead property set with PROPPATCH after each upload. The
+// server needs to support dead properties
+type WebDAVStorage struct {
+	config WebDAVConfig
+	root   *url.URL // Path ends with /
+}
+
+// NewWebDAVStorage returns a storage in the collection of config. It checks
+// that the collection exists
+func NewWebDAVStorage(config WebDAVConfig) (*WebDAVStorage, error) {
+	root, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid webdav url")
+	}
+	if root.Scheme != "http" && root.Scheme != "https" {
+		return nil, errors.New("webdav storage needs an http or https url")
+	}
+	if !strings.HasSuffix(root.Path, "/") {
+		root.Path += "/"
+	}
+	root.RawPath = ""
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+	s := &WebDAVStorage{config: config, root: root}
+	dir, err := s.isDirectory(".")
+	if err == nil && !dir {
+		err = errors.New("not a collection")
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read "+config.URL)
+	}
+	return s, nil
+}
+
+// webdavError is an error status answered by the server
+type webdavError struct {
+	Method     string
+	StatusCode int
+}
+
+func (e *webdavError) Error() string {
+	return fmt.Sprintf("webdav: %s: status %d", e.Method, e.StatusCode)
+}
+
+// url returns the url of the resource at relative
+func (s *WebDAVStorage) url(relative string) (*url.URL, error) {
+	p := path.Clean(relative)
+	if p == ".." || strings.HasPrefix(p, "../") || strings.HasPrefix(p, "/") {
+		return nil, ErrNotInRoot
+	}
+	u := *s.root
+	if p != "." {
+		u.Path += p
+	}
+	return &u, nil
+}
+
+// do sends a request for the resource at relative. It fails if the server
+// doesn't answer with a 2xx status, with ErrNotExist as cause for a 404. The
+// body of the answer should be closed otherwise
+func (s *WebDAVStorage) do(method, relative string, header http.Header, body io.Reader) (*http.Response, error) {
+	u, err := s.url(relative)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if s.config.Username != "" {
+		req.SetBasicAuth(s.config.Username, s.config.Password)
+	}
+	resp, err := s.config.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		err = &webdavError{Method: method, StatusCode: resp.StatusCode}
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, errors.Wrap(ErrNotExist, err.Error())
+		}
+		return nil, err
+	}
+	return resp, nil
+}
+
+// webdavMultistatus is the answer of PROPFIND and PROPPATCH
+type webdavMultistatus struct {
+	Responses []struct {
+		Href     string `xml:"DAV: href"`
+		Propstat []struct {
+			Prop   webdavProp `xml:"DAV: prop"`
+			Status string     `xml:"DAV: status"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+// webdavProp holds the properties of a resource. They are strings since the
+// missing ones are answered empty
+type webdavProp struct {
+	ResourceType struct {
+		Collection *struct{} `xml:"DAV: collection"`
+	} `xml:"DAV: resourcetype"`
+	ContentLength string `xml:"DAV: getcontentlength"`
+	LastModified  string `xml:"DAV: getlastmodified"`
+	ModTime       string `xml:"https://github.com/Viq111/tri mtime"`
+}
+
+// webdavStatusOK returns whether a propstat status line is a success
+func webdavStatusOK(status string) bool {
+	fields := strings.Fields(status)
+	return len(fields) >= 2 && strings.HasPrefix(fields[1], "2")
+}
+
+// multistatus sends a request whose answer is a multistatus
+func (s *WebDAVStorage) multistatus(method, relative string, header http.Header, body []byte) (webdavMultistatus, error) {
+	var ms webdavMultistatus
+	header.Set("Content-Type", "application/xml; charset=utf-8")
+	resp, err := s.do(method, relative, header, bytes.NewReader(body))
+	if err != nil {
+		return ms, err
+	}
+	defer resp.Body.Close()
+	err = xml.NewDecoder(resp.Body).Decode(&ms)
+	return ms, errors.Wrap(err, "invalid "+method+" answer")
+}
+
+// propfind returns the resources at relative, itself first, and its children
+// if depth is 1
+func (s *WebDAVStorage) propfind(relative string, depth int) ([]StoreObject, error) {
+	header := http.Header{"Depth": {strconv.Itoa(depth)}}
+	ms, err := s.multistatus("PROPFIND", relative, header, webdavPropfind)
+	if err != nil {
+		return nil, err
+	}
+	self, err := s.url(relative)
+	if err != nil {
+		return nil, err
+	}
+	selfPath := path.Clean(self.Path)
+	nodes := []StoreObject{{}}
+	for _, r := range ms.Responses {
+		href, err := url.Parse(r.Href)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid PROPFIND answer")
+		}
+		var node StoreObject
+		var modTime string
+		for _, p := range r.Propstat {
+			if !webdavStatusOK(p.Status) {
+				continue
+			}
+			if p.Prop.ResourceType.Collection != nil {
+				node.IsDirectory = true
+			}
+			if size, err := strconv.Atoi(p.Prop.ContentLength); err == nil {
+				node.Size = size
+			}
+			if t, err := http.ParseTime(p.Prop.LastModified); err == nil {
+				node.Modified = t
+			}
+			if p.Prop.ModTime != "" {
+				modTime = p.Prop.ModTime
+			}
+		}
+		if t, err := time.Parse(time.RFC3339Nano, modTime); err == nil {
+			node.Modified = t
+		}
+		hrefPath := path.Clean(href.Path)
+		if hrefPath == selfPath {
+			node.Name = path.Base(relative)
+			nodes[0] = node
+			continue
+		}
+		node.Name = path.Base(hrefPath)
+		nodes = append(nodes, node)
+	}
+	if nodes[0].Name == "" {
+		return nil, errors.New("invalid PROPFIND answer, missing " + relative)
+	}
+	return nodes, nil
+}
+
+// isDirectory returns whether relative is a collection, ErrNotExist if it
+// doesn't exist
+func (s *WebDAVStorage) isDirectory(relative string) (bool, error) {
+	nodes, err := s.propfind(relative, 0)
+	if err != nil {
+		return false, err
+	}
+	return nodes[0].IsDirectory, nil
+}
+
+// Download returns an object that can be read
+func (s *WebDAVStorage) Download(relative string) (io.ReadCloser, error) {
+	resp, err := s.do(http.MethodGet, relative, nil, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to download "+relative)
+	}
+	return resp.Body, nil
+}
+
+// List returns a list of node in the path
+func (s *WebDAVStorage) List(relative string) ([]StoreObject, error) {
+	nodes, err := s.propfind(relative, 1)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list "+relative)
+	}
+	if !nodes[0].IsDirectory {
+		return nil, errors.New(relative + " is not a directory")
+	}
+	return nodes[1:], nil
+}
+
+// Mkdir creates a directory and potentially parents
+func (s *WebDAVStorage) Mkdir(relative string) error {
+	if _, err := s.url(relative); err != nil {
+		return err
+	}
+	p := path.Clean(relative)
+	if p == "." {
+		return nil // The root always exists
+	}
+	dir, err := s.isDirectory(p)
+	if err == nil {
+		if !dir {
+			return errors.New(relative + " is not a directory")
+		}
+		return nil
+	}
+	if errors.Cause(err) != ErrNotExist {
+		return err
+	}
+	if err = s.Mkdir(path.Dir(p)); err != nil {
+		return err
+	}
+	resp, err := s.do("MKCOL", p, nil, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to create directory "+relative)
+	}
+	return resp.Body.Close()
+}
+
+// Move moves a file to a new location, this can only move files and not
+// folders. An existing file at dst is replaced
+func (s *WebDAVStorage) Move(src, dst string) error {
+	dstURL, err := s.url(dst)
+	if err != nil {
+		return err
+	}
+	dir, err := s.isDirectory(src)
+	if err != nil {
+		return err
+	}
+	if dir {
+		return ErrDirectory
+	}
+	header := http.Header{"Destination": {dstURL.String()}, "Overwrite": {"T"}}
+	resp, err := s.do("MOVE", src, header, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to move "+src+" to "+dst)
+	}
+	return resp.Body.Close()
+}
+
+// Remove a path (file or empty directory). WebDAV removes collections with
+// their children so it checks that directories are empty first
+func (s *WebDAVStorage) Remove(relative string) error {
+	nodes, err := s.propfind(relative, 1)
+	if err != nil {
+		return err
+	}
+	if len(nodes) > 1 {
+		return errors.Wrap(ErrDirectoryNotEmpty, relative)
+	}
+	resp, err := s.do(http.MethodDelete, relative, nil, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to remove "+relative)
+	}
+	return resp.Body.Close()
+}
+
+// setModTime stores the modification time of the file at relative
+func (s *WebDAVStorage) setModTime(relative string, modTime time.Time) error {
+	body := []byte(`<?xml version="1.0" encoding="utf-8"?>
+<D:propertyupdate xmlns:D="DAV:" xmlns:T="` + webdavNamespace + `"><D:set><D:prop>` +
+		`<T:mtime>` + modTime.UTC().Format(time.RFC3339Nano) + `</T:mtime>` +
+		`</D:prop></D:set></D:propertyupdate>`)
+	ms, err := s.multistatus("PROPPATCH", relative, http.Header{}, body)
+	if err != nil {
+		return err
+	}
+	for _, r := range ms.Responses {
+		for _, p := range r.Propstat {
+			if !webdavStatusOK(p.Status) {
+				return errors.New("server refused the property: " + p.Status)
+			}
+		}
+	}
+	return nil
+}
+
+// webdavWriter streams a file to the server with a PUT, then sets its
+// modification time
+type webdavWriter struct {
+	*io.PipeWriter
+	s        *WebDAVStorage
+	relative string
+	modTime  time.Time
+	done     chan error // Result of the PUT
+	closed   bool
+}
+
+func (w *webdavWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	w.PipeWriter.Close()
+	if err := <-w.done; err != nil {
+		return errors.Wrap(err, "failed to upload "+w.relative)
+	}
+	return errors.Wrap(w.s.setModTime(w.relative, w.modTime), "failed to set modification time of "+w.relative)
+}
+
+// Upload returns an object that can be written to. It will create the
+// file if it doesn't already exist. If it exists, it will overrides it
+func (s *WebDAVStorage) Upload(relative string, modTime time.Time) (io.WriteCloser, error) {
+	if _, err := s.url(relative); err != nil {
+		return nil, err
+	}
+	r, pw := io.Pipe()
+	w := &webdavWriter{
+		PipeWriter: pw,
+		s:          s,
+		relative:   relative,
+		modTime:    modTime,
+		done:       make(chan error, 1),
+	}
+	go func() {
+		resp, err := s.do(http.MethodPut, relative, nil, r)
+		if err == nil {
+			err = resp.Body.Close()
+		}
+		r.CloseWithError(err) // Fails the writes if the request ended early
+		w.done <- err
+	}()
+	return w, nil
+}
@@ -0,0 +1,168 @@
+package storage
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/webdav"
+)
+
+// serveWebDAV starts a WebDAV server, with the password "secret", in memory.
+// Its root has a backups collection. It returns the server with its file
+// system
+func serveWebDAV(t *testing.T) (*httptest.Server, webdav.FileSystem) {
+	fs := webdav.NewMemFS()
+	if err := fs.Mkdir(context.Background(), "/backups", 0755); err != nil {
+		t.Fatalf("Failed to create root: %s", err)
+	}
+	handler := &webdav.Handler{
+		Prefix:     "/dav",
+		FileSystem: fs,
+		LockSystem: webdav.NewMemLS(),
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, _ := r.BasicAuth(); user != "tri" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	return server, fs
+}
+
+// resetWebDAV fills the backups collection of fs like getLocalStorageAndCleanup
+func resetWebDAV(fs webdav.FileSystem) error {
+	ctx := context.Background()
+	if err := fs.RemoveAll(ctx, "/backups"); err != nil {
+		return err
+	}
+	for _, d := range []string{"/backups", "/backups/folder_a", "/backups/folder_a/folder_b", "/backups/folder_a/folder_empty", "/backups/folder_empty"} {
+		if err := fs.Mkdir(ctx, d, 0755); err != nil {
+			return err
+		}
+	}
+	for _, f := range []string{"/backups/file_a", "/backups/folder_a/folder_b/file_b"} {
+		file, err := fs.OpenFile(ctx, f, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		file.Close()
+	}
+	return nil
+}
+
+func TestWebDAVStorage(t *testing.T) {
+	assert := assert.New(t)
+	server, fs := serveWebDAV(t)
+	defer server.Close()
+	if !assert.NoError(resetWebDAV(fs)) {
+		t.FailNow()
+	}
+	s, err := NewWebDAVStorage(WebDAVConfig{URL: server.URL + "/dav/backups", Username: "tri", Password: "secret"})
+	if !assert.NoError(err) {
+		t.FailNow()
+	}
+	t.Run("WebDAVStorage", RunStorageTests(NewStorageTester(s, func() error { return resetWebDAV(fs) })))
+
+	_, err = NewWebDAVStorage(WebDAVConfig{URL: server.URL + "/dav/backups", Username: "tri", Password: "wrong"})
+	assert.Error(err, "the password should be checked")
+	_, err = NewWebDAVStorage(WebDAVConfig{URL: server.URL + "/dav/missing", Username: "tri", Password: "secret"})
+	assert.Equal(ErrNotExist, errors.Cause(err))
+}
+
+func TestWebDAVStorageSync(t *testing.T) {
+	assert := assert.New(t)
+	server, _ := serveWebDAV(t)
+	defer server.Close()
+	s, err := NewWebDAVStorage(WebDAVConfig{URL: server.URL + "/dav/backups/", Username: "tri", Password: "secret"})
+	if !assert.NoError(err) {
+		t.FailNow()
+	}
+	src, cleanupSrc := newTempLocalStorage(t)
+	defer cleanupSrc()
+	writeFile(t, src.Root, "folder/file a+%", "a")
+	writeFile(t, src.Root, "folder/file_b", "b")
+	writeFile(t, src.Root, "file_c", "")
+	modTime := time.Date(2020, time.May, 17, 20, 10, 6, 123456789, time.UTC)
+	assert.NoError(os.Chtimes(src.Root+"/folder/file a+%", modTime, modTime))
+
+	assert.NoError(s.Mkdir("docs/2020"))
+	assert.NoError(SyncWithOptions(src, ".", s, "docs/2020", SyncOptions{Transfers: 4}))
+	r, err := s.Download("docs/2020/folder/file a+%")
+	if assert.NoError(err) {
+		content, err := ioutil.ReadAll(r)
+		assert.NoError(err)
+		assert.Equal("a", string(content))
+		r.Close()
+	}
+	listing, err := s.List("docs/2020/folder")
+	if assert.NoError(err) && assert.Len(listing, 2) {
+		sort.Sort(sortAlphabetical(listing))
+		assert.Equal("file a+%", listing[0].Name)
+		assert.True(modTime.Equal(listing[0].Modified), "the modification time should be kept")
+		assert.Equal(1, listing[0].Size)
+	}
+
+	// Modification times are kept so nothing is copied again
+	assert.NoError(Sync(src, ".", s, "docs/2020"))
+	bin, err := s.List("docs/2020/" + BinDirectory)
+	if errors.Cause(err) != ErrNotExist && assert.NoError(err) {
+		assert.Empty(bin, "nothing should have been replaced")
+	}
+
+	// Errors
+	_, err = s.Download("docs/missing")
+	assert.Equal(ErrNotExist, errors.Cause(err))
+	assert.Equal(ErrDirectoryNotEmpty, errors.Cause(s.Remove("docs/2020/folder")))
+	assert.Equal(ErrDirectory, s.Move("docs/2020/folder", "docs/other"))
+	_, err = s.List("docs/missing")
+	assert.Equal(ErrNotExist, errors.Cause(err))
+	_, err = s.List("..")
+	assert.Equal(ErrNotInRoot, errors.Cause(err))
+}
+
+func TestWebDAVStorageErrors(t *testing.T) {
+	assert := assert.New(t)
+	server, fs := serveWebDAV(t)
+	defer server.Close()
+	if !assert.NoError(resetWebDAV(fs)) {
+		t.FailNow()
+	}
+	config := WebDAVConfig{URL: server.URL + "/dav/backups", Username: "tri", Password: "secret"}
+	s, err := NewWebDAVStorage(config)
+	if !assert.NoError(err) {
+		t.FailNow()
+	}
+
+	// The password changed since: every request is answered 401
+	s.config.Password = "wrong"
+	done := make(chan []error, 1)
+	go func() {
+		_, listErr := s.List(".")
+		_, downloadErr := s.Download("file_a")
+		errs := []error{listErr, downloadErr, s.Mkdir("folder_b/folder_c"), s.Move("file_a", "file_b"), s.Remove("file_a")}
+		for _, err := range errs {
+			errors.Cause(err)
+			asFileErrors(err)
+		}
+		done <- errs
+	}()
+	select {
+	case errs := <-done:
+		for _, err := range errs {
+			if assert.Error(err) {
+				assert.NotEqual(ErrNotExist, errors.Cause(err))
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("WebDAVStorage hangs on status 401")
+	}
+}